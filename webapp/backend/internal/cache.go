@@ -2,6 +2,7 @@ package cache
 
 import (
 	"backend/internal/model"
+	"backend/internal/utils"
 	"log"
 	"sync"
 	"time"
@@ -13,8 +14,12 @@ type cache struct {
 	ProductsCnt  int
 	ProductsById []model.Product
 
-	Order                  sync.RWMutex
+	Order sync.RWMutex
+	// 商品IDごとの在庫数。注文の作成・キャンセルで変わるため Order のロック下で読み書きする
+	// (ProductsById の Stock は起動時の値のまま更新しない)
+	ProductStock           []int
 	ShippingOrderProductId map[int64]int
+	RobotOrderIds          map[string]map[int64]struct{}
 	UserOrders             []([]model.Order)
 	OrderIdUserId          map[int64]struct {
 		UserID int
@@ -26,6 +31,22 @@ type cache struct {
 
 var Cache cache
 
+var ready = make(chan struct{})
+
+// shipping の注文が増えたときに通知する
+var ShippingOrdersNotifier = utils.NewNotifier()
+
+// ユーザーごとに保持する注文ステータスの変更イベントの件数
+const orderEventsPerUser = 256
+
+// ユーザーごとの注文ステータスの変更。UpdateOrder で注文の作成やステータスの変更を検知して追記する
+var OrderEvents = utils.NewEventLog[model.UserOrderEvent](orderEventsPerUser)
+
+// InitCache が完了すると close されるチャネルを返す
+func Ready() <-chan struct{} {
+	return ready
+}
+
 func InitCache(dbConn *sqlx.DB) {
 	var tmp int
 
@@ -54,7 +75,9 @@ func InitCache(dbConn *sqlx.DB) {
 
 	Cache = cache{
 		ProductsById:           make([]model.Product, len(products)+1),
+		ProductStock:           make([]int, len(products)+1),
 		ShippingOrderProductId: make(map[int64]int),
+		RobotOrderIds:          make(map[string]map[int64]struct{}),
 		UserOrders:             make([][]model.Order, len(users)+1),
 		OrderIdUserId: make(map[int64]struct {
 			UserID int
@@ -70,6 +93,7 @@ func InitCache(dbConn *sqlx.DB) {
 
 	for _, p := range products {
 		Cache.ProductsById[p.ProductID] = p
+		Cache.ProductStock[p.ProductID] = p.Stock
 	}
 
 	var orders []model.Order
@@ -80,6 +104,7 @@ func InitCache(dbConn *sqlx.DB) {
 		UpdateOrder(o)
 	}
 	log.Println("InitCache done")
+	close(ready)
 }
 
 func UpdateOrder(order model.Order) {
@@ -90,6 +115,16 @@ func UpdateOrder(order model.Order) {
 	}
 
 	e, ok := Cache.OrderIdUserId[order.OrderID]
+	previous := ""
+	if ok {
+		previous = Cache.UserOrders[e.UserID][e.Index].ShippedStatus
+		untrackRobotOrder(Cache.UserOrders[e.UserID][e.Index])
+	}
+	trackRobotOrder(order)
+	if !ok || previous != order.ShippedStatus {
+		publishOrderEvent(order, previous)
+	}
+
 	if !ok {
 		Cache.UserOrders[order.UserID] = append(Cache.UserOrders[order.UserID], order)
 		Cache.OrderIdUserId[order.OrderID] = struct {
@@ -100,3 +135,54 @@ func UpdateOrder(order model.Order) {
 		Cache.UserOrders[e.UserID][e.Index] = order
 	}
 }
+
+// 注文の作成・ステータスの変更をユーザーに配信する
+// 起動時のキャッシュの読み込みは変更ではないため配信しない
+// リポジトリはトランザクションのコミット後に UpdateOrder を呼ぶため、ロールバックされた変更は配信されない
+func publishOrderEvent(order model.Order, previous string) {
+	select {
+	case <-ready:
+	default:
+		return
+	}
+	event := model.UserOrderEvent{
+		OrderID:        order.OrderID,
+		GroupID:        order.GroupID,
+		ProductID:      order.ProductID,
+		Quantity:       order.Quantity,
+		Status:         order.ShippedStatus,
+		PreviousStatus: previous,
+		ChangedAt:      time.Now(),
+	}
+	if order.ArrivedAt.Valid {
+		event.ArrivedAt = &order.ArrivedAt.Time
+	}
+	OrderEvents.Append(order.UserID, event)
+}
+
+// 配送中の注文をロボットIDごとに索引する
+func trackRobotOrder(order model.Order) {
+	if order.ShippedStatus != "delivering" || !order.RobotID.Valid {
+		return
+	}
+	ids, ok := Cache.RobotOrderIds[order.RobotID.String]
+	if !ok {
+		ids = make(map[int64]struct{})
+		Cache.RobotOrderIds[order.RobotID.String] = ids
+	}
+	ids[order.OrderID] = struct{}{}
+}
+
+func untrackRobotOrder(order model.Order) {
+	if !order.RobotID.Valid {
+		return
+	}
+	ids, ok := Cache.RobotOrderIds[order.RobotID.String]
+	if !ok {
+		return
+	}
+	delete(ids, order.OrderID)
+	if len(ids) == 0 {
+		delete(Cache.RobotOrderIds, order.RobotID.String)
+	}
+}
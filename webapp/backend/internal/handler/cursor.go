@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"backend/internal/utils"
+)
+
+// リクエストのカーソルの署名を検証し、req.After に復元する
+func decodeListCursor(signer *utils.CursorSigner, req *model.ListRequest) error {
+	if req.Cursor == "" {
+		return nil
+	}
+	var c model.ListCursor
+	if err := signer.Decode(req.Cursor, &c); err != nil {
+		return err
+	}
+	req.After = &c
+	return nil
+}
+
+// 次のページのカーソルを署名付きの文字列にする。続きがなければ空文字を返す
+func encodeListCursor(signer *utils.CursorSigner, c *model.ListCursor) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	return signer.Encode(c)
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"backend/internal/middleware"
+	"backend/internal/model"
+	"backend/internal/service"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type DeliveryPlanHandler struct {
+	DeliveryPlanSvc *service.DeliveryPlanService
+}
+
+func NewDeliveryPlanHandler(svc *service.DeliveryPlanService) *DeliveryPlanHandler {
+	return &DeliveryPlanHandler{DeliveryPlanSvc: svc}
+}
+
+// 共通キーで履歴を取得しようとした場合のエラーメッセージ
+const errPerRobotKeyRequired = "Forbidden: a per-robot key is required to read delivery plan history"
+
+// 配送計画の履歴一覧を取得 (ロボット用)
+// ロボットごとのキーで認証されたロボット自身の計画のみを返す
+// 共通キーではロボットを特定できず、他のロボットの計画が見えてしまうため拒否する
+func (h *DeliveryPlanHandler) List(w http.ResponseWriter, r *http.Request) {
+	robotID, ok := middleware.GetRobotFromContext(r.Context())
+	if !ok {
+		http.Error(w, errPerRobotKeyRequired, http.StatusForbidden)
+		return
+	}
+	h.list(w, r, robotID)
+}
+
+// 配送計画の履歴一覧を取得 (管理用)
+// クエリパラメータ robot_id で絞り込める
+func (h *DeliveryPlanHandler) AdminList(w http.ResponseWriter, r *http.Request) {
+	h.list(w, r, r.URL.Query().Get("robot_id"))
+}
+
+// クエリパラメータ: before (この計画IDより古いもの), limit
+// robotID が空の場合はすべてのロボットの計画を返す
+func (h *DeliveryPlanHandler) list(w http.ResponseWriter, r *http.Request, robotID string) {
+	q := r.URL.Query()
+	var beforeID int64
+	if v := q.Get("before"); v != "" {
+		var err error
+		beforeID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Query parameter 'before' must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Query parameter 'limit' must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	plans, err := h.DeliveryPlanSvc.ListPlans(r.Context(), robotID, beforeID, limit)
+	if err != nil {
+		log.Printf("Failed to list delivery plans: %v", err)
+		http.Error(w, "Failed to list delivery plans", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Data []model.DeliveryPlanRecord `json:"data"`
+	}{
+		Data: plans,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// 配送計画の履歴を、含まれる注文の配送結果とともに取得 (ロボット用)
+// ロボットごとのキーで認証されたロボット自身の計画のみを返す
+func (h *DeliveryPlanHandler) Get(w http.ResponseWriter, r *http.Request) {
+	robotID, ok := middleware.GetRobotFromContext(r.Context())
+	if !ok {
+		http.Error(w, errPerRobotKeyRequired, http.StatusForbidden)
+		return
+	}
+	h.get(w, r, robotID)
+}
+
+// 配送計画の履歴を、含まれる注文の配送結果とともに取得 (管理用)
+func (h *DeliveryPlanHandler) AdminGet(w http.ResponseWriter, r *http.Request) {
+	h.get(w, r, "")
+}
+
+// robotID が空でなければ、そのロボットの計画でない場合は見つからないものとして扱う
+func (h *DeliveryPlanHandler) get(w http.ResponseWriter, r *http.Request, robotID string) {
+	planID, err := strconv.ParseInt(chi.URLParam(r, "planID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid plan ID", http.StatusBadRequest)
+		return
+	}
+
+	plan, err := h.DeliveryPlanSvc.GetPlan(r.Context(), planID)
+	if err != nil {
+		if errors.Is(err, service.ErrDeliveryPlanNotFound) {
+			http.Error(w, "Delivery plan not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to get delivery plan %d: %v", planID, err)
+		http.Error(w, "Failed to get delivery plan", http.StatusInternalServerError)
+		return
+	}
+	if robotID != "" && plan.RobotID != robotID {
+		http.Error(w, "Delivery plan not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
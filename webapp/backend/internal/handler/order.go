@@ -4,20 +4,28 @@ import (
 	"backend/internal/middleware"
 	"backend/internal/model"
 	"backend/internal/service"
+	"backend/internal/utils"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
 )
 
 type OrderHandler struct {
 	OrderSvc *service.OrderService
+	cursors  *utils.CursorSigner
 }
 
-func NewOrderHandler(svc *service.OrderService) *OrderHandler {
-	return &OrderHandler{OrderSvc: svc}
+func NewOrderHandler(svc *service.OrderService, cursors *utils.CursorSigner) *OrderHandler {
+	return &OrderHandler{OrderSvc: svc, cursors: cursors}
 }
 
 // 注文履歴一覧を取得
+// grouped が true の場合は親注文ごとにまとめて返す
+// cursor を指定した場合は page の代わりに前回のレスポンスの next_cursor の続きを返す
 func (h *OrderHandler) List(w http.ResponseWriter, r *http.Request) {
 	userID, ok := middleware.GetUserFromContext(r.Context())
 	if !ok {
@@ -47,22 +55,124 @@ func (h *OrderHandler) List(w http.ResponseWriter, r *http.Request) {
 	if req.Type != "" && req.Type != "partial" && req.Type != "prefix" {
 		req.Type = "partial"
 	}
+	req.Offset = (req.Page - 1) * req.PageSize
+	if err := decodeListCursor(h.cursors, &req); err != nil {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	if req.Grouped {
+		if req.After != nil {
+			http.Error(w, "Cursor is not supported for grouped orders", http.StatusBadRequest)
+			return
+		}
+		groups, total, err := h.OrderSvc.FetchOrderGroups(r.Context(), userID, req)
+		if err != nil {
+			log.Printf("Failed to fetch order groups for user %d: %v", userID, err)
+			http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
+			return
+		}
+		resp := struct {
+			Data  []model.OrderGroup `json:"data"`
+			Total int                `json:"total"`
+		}{
+			Data:  groups,
+			Total: total,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
 
-	orders, total, err := h.OrderSvc.FetchOrders(r.Context(), userID, req)
+	orders, total, next, err := h.OrderSvc.FetchOrders(r.Context(), userID, req)
 	if err != nil {
+		if errors.Is(err, service.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
 		log.Printf("Failed to fetch orders for user %d: %v", userID, err)
 		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
 		return
 	}
+	nextCursor, err := encodeListCursor(h.cursors, next)
+	if err != nil {
+		log.Printf("Failed to encode order cursor for user %d: %v", userID, err)
+		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
+		return
+	}
 
 	resp := struct {
-		Data  []model.Order `json:"data"`
-		Total int           `json:"total"`
+		Data       []model.Order `json:"data"`
+		Total      int           `json:"total"`
+		NextCursor string        `json:"next_cursor"`
 	}{
-		Data:  orders,
-		Total: total,
+		Data:       orders,
+		Total:      total,
+		NextCursor: nextCursor,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
+
+// 注文の詳細を取得
+// 商品情報とステータスの変更履歴を含む。自分の注文のみ取得できる
+func (h *OrderHandler) Get(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	orderID, err := strconv.ParseInt(chi.URLParam(r, "orderID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	detail, err := h.OrderSvc.GetOrderDetail(r.Context(), userID, orderID)
+	if err != nil {
+		if errors.Is(err, service.ErrOrderNotFound) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to get order %d for user %d: %v", orderID, userID, err)
+		http.Error(w, "Failed to get order", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// 注文をキャンセル
+// 配送待ち(shipping)の自分の注文のみキャンセルできる
+func (h *OrderHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	orderID, err := strconv.ParseInt(chi.URLParam(r, "orderID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.OrderSvc.CancelOrder(r.Context(), userID, orderID); err != nil {
+		switch {
+		case errors.Is(err, service.ErrOrderNotFound):
+			http.Error(w, "Order not found", http.StatusNotFound)
+		case errors.Is(err, service.ErrInvalidStatusTransition):
+			http.Error(w, "Order can no longer be cancelled", http.StatusConflict)
+		default:
+			log.Printf("Failed to cancel order %d for user %d: %v", orderID, userID, err)
+			http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Order cancelled"))
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"backend/internal/middleware"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// 接続を維持するためのコメント行の送信間隔
+	orderEventsHeartbeatInterval = 15 * time.Second
+	// 切断されたクライアントが再接続するまでの待ち時間 (ミリ秒)
+	orderEventsRetryMillis = 3000
+)
+
+// 注文ステータスの変更を Server-Sent Events で配信する
+//
+// 各イベントの id は配信順に増加し、再接続時に Last-Event-ID ヘッダー (または last_event_id パラメータ) で
+// 受け取った最後の id を指定すると、その続きから配信する。指定がなければ接続以降の変更のみを配信する。
+// 続きを配信できない場合 (保持している件数を超えた・サーバーが再起動した) は reset イベントを送るため、
+// クライアントは注文履歴を取得し直すこと。
+func (h *OrderHandler) Events(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	afterID := h.OrderSvc.LatestOrderEventID()
+	if lastEventID != "" {
+		var err error
+		afterID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", orderEventsRetryMillis)
+	flusher.Flush()
+
+	ctx := r.Context()
+	heartbeat := time.NewTicker(orderEventsHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		events, complete, changed := h.OrderSvc.OrderEventsSince(userID, afterID)
+		if !complete {
+			// 取りこぼした変更は送れないため、以降は最新の変更から配信する
+			afterID = h.OrderSvc.LatestOrderEventID()
+			events, _, changed = h.OrderSvc.OrderEventsSince(userID, afterID)
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", afterID); err != nil {
+				return
+			}
+		}
+
+		for _, e := range events {
+			data, err := json.Marshal(e.Value)
+			if err != nil {
+				log.Printf("Failed to encode order event for user %d: %v", userID, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: order_status\ndata: %s\n\n", e.ID, data); err != nil {
+				return
+			}
+			afterID = e.ID
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
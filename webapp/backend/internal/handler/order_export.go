@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"backend/internal/middleware"
+	"backend/internal/model"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+)
+
+var orderExportColumns = []string{
+	"order_id", "group_id", "product_id", "product_name", "quantity", "shipped_status", "created_at", "arrived_at",
+}
+
+// format パラメータ、なければ Accept ヘッダから出力形式を決める。どちらもなければ CSV
+func exportFormatFromRequest(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case exportFormatCSV, exportFormatNDJSON:
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("Unknown format: %s", format)
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/x-ndjson") || strings.Contains(accept, "application/ndjson") {
+		return exportFormatNDJSON, nil
+	}
+	return exportFormatCSV, nil
+}
+
+// クエリパラメータから注文履歴の絞り込み条件を読み取る
+// パラメータ名は ListRequest の JSON と同じで、複数指定できる条件はパラメータを繰り返す
+func listRequestFromQuery(r *http.Request) (model.ListRequest, error) {
+	q := r.URL.Query()
+	req := model.ListRequest{
+		Search:          q.Get("search"),
+		Type:            q.Get("type"),
+		ShippedStatuses: q["shipped_statuses"],
+	}
+	if req.Type != "" && req.Type != "partial" && req.Type != "prefix" {
+		req.Type = "partial"
+	}
+	for _, v := range q["product_ids"] {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return req, errors.New("Query parameter 'product_ids' must be integers")
+		}
+		req.ProductIDs = append(req.ProductIDs, id)
+	}
+	times := []struct {
+		name string
+		dst  **time.Time
+	}{
+		{"created_from", &req.CreatedFrom},
+		{"created_to", &req.CreatedTo},
+		{"arrived_from", &req.ArrivedFrom},
+		{"arrived_to", &req.ArrivedTo},
+	}
+	for _, t := range times {
+		v := q.Get(t.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return req, fmt.Errorf("Query parameter '%s' must be an RFC 3339 timestamp", t.name)
+		}
+		*t.dst = &parsed
+	}
+	return req, nil
+}
+
+func toOrderExportRow(o model.Order) model.OrderExportRow {
+	row := model.OrderExportRow{
+		OrderID:       o.OrderID,
+		GroupID:       o.GroupID,
+		ProductID:     o.ProductID,
+		ProductName:   o.ProductName,
+		Quantity:      o.Quantity,
+		ShippedStatus: o.ShippedStatus,
+		CreatedAt:     o.CreatedAt,
+	}
+	if o.ArrivedAt.Valid {
+		row.ArrivedAt = &o.ArrivedAt.Time
+	}
+	return row
+}
+
+func csvRecord(row model.OrderExportRow) []string {
+	arrivedAt := ""
+	if row.ArrivedAt != nil {
+		arrivedAt = row.ArrivedAt.Format(time.RFC3339)
+	}
+	return []string{
+		strconv.FormatInt(row.OrderID, 10),
+		strconv.FormatInt(row.GroupID, 10),
+		strconv.Itoa(row.ProductID),
+		row.ProductName,
+		strconv.Itoa(row.Quantity),
+		row.ShippedStatus,
+		row.CreatedAt.Format(time.RFC3339),
+		arrivedAt,
+	}
+}
+
+// 注文履歴をすべて CSV または NDJSON でダウンロードする
+// 絞り込み条件は一覧と同じで、ページングはせず作成順に少しずつ書き出す
+func (h *OrderHandler) Export(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	format, err := exportFormatFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := listRequestFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filename := "orders-" + time.Now().Format("20060102") + "." + format
+	if format == exportFormatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	flusher, _ := w.(http.Flusher)
+	csvWriter := csv.NewWriter(w)
+	jsonEncoder := json.NewEncoder(w)
+	if format == exportFormatCSV {
+		csvWriter.Write(orderExportColumns)
+	}
+
+	// ヘッダを送った後はステータスを変えられないため、途中のエラーはログに残して打ち切る
+	err = h.OrderSvc.ExportOrders(r.Context(), userID, req, func(orders []model.Order) error {
+		for _, o := range orders {
+			row := toOrderExportRow(o)
+			if format == exportFormatCSV {
+				if err := csvWriter.Write(csvRecord(row)); err != nil {
+					return err
+				}
+			} else if err := jsonEncoder.Encode(row); err != nil {
+				return err
+			}
+		}
+		if format == exportFormatCSV {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if format == exportFormatCSV {
+		csvWriter.Flush()
+	}
+	if err != nil {
+		log.Printf("Failed to export orders for user %d: %v", userID, err)
+	}
+}
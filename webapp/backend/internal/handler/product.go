@@ -4,7 +4,9 @@ import (
 	"backend/internal/middleware"
 	"backend/internal/model"
 	"backend/internal/service"
+	"backend/internal/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -15,13 +17,15 @@ import (
 
 type ProductHandler struct {
 	ProductSvc *service.ProductService
+	cursors    *utils.CursorSigner
 }
 
-func NewProductHandler(svc *service.ProductService) *ProductHandler {
-	return &ProductHandler{ProductSvc: svc}
+func NewProductHandler(svc *service.ProductService, cursors *utils.CursorSigner) *ProductHandler {
+	return &ProductHandler{ProductSvc: svc, cursors: cursors}
 }
 
 // 商品一覧を取得
+// cursor を指定した場合は page の代わりに前回のレスポンスの next_cursor の続きを返す
 func (h *ProductHandler) List(w http.ResponseWriter, r *http.Request) {
 	userID, ok := middleware.GetUserFromContext(r.Context())
 	if !ok {
@@ -48,20 +52,46 @@ func (h *ProductHandler) List(w http.ResponseWriter, r *http.Request) {
 		req.SortOrder = "asc"
 	}
 	req.Offset = (req.Page - 1) * req.PageSize
+	if err := decodeListCursor(h.cursors, &req); err != nil {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
 
-	products, total, err := h.ProductSvc.FetchProducts(r.Context(), userID, req)
+	products, total, next, err := h.ProductSvc.FetchProducts(r.Context(), userID, req)
 	if err != nil {
+		if errors.Is(err, service.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
 		log.Printf("Failed to fetch products for user %d: %v", userID, err)
 		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
 		return
 	}
+	nextCursor, err := encodeListCursor(h.cursors, next)
+	if err != nil {
+		log.Printf("Failed to encode product cursor for user %d: %v", userID, err)
+		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+		return
+	}
+
+	// 在庫は従来のレスポンスに含まれないため、在庫で絞り込むか include_stock を指定した場合のみ返す
+	var data interface{} = products
+	if req.InStockOnly || req.IncludeStock {
+		withStock := make([]model.ProductWithStock, len(products))
+		for i, p := range products {
+			withStock[i] = model.ProductWithStock{Product: p, Stock: p.Stock, InStock: p.InStock}
+		}
+		data = withStock
+	}
 
 	resp := struct {
-		Data  []model.Product `json:"data"`
-		Total int             `json:"total"`
+		Data       interface{} `json:"data"`
+		Total      int         `json:"total"`
+		NextCursor string      `json:"next_cursor"`
 	}{
-		Data:  products,
-		Total: total,
+		Data:       data,
+		Total:      total,
+		NextCursor: nextCursor,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -83,8 +113,22 @@ func (h *ProductHandler) CreateOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	insertedOrderIDs, err := h.ProductSvc.CreateOrders(r.Context(), userID, req.Items)
+	groupID, insertedOrderIDs, err := h.ProductSvc.CreateOrders(r.Context(), userID, req.Items)
 	if err != nil {
+		var validationErr *service.OrderValidationError
+		if errors.As(err, &validationErr) {
+			resp := struct {
+				Message string                 `json:"message"`
+				Errors  []model.OrderItemError `json:"errors"`
+			}{
+				Message: "Invalid order request",
+				Errors:  validationErr.Errors,
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
 		log.Printf("Failed to create orders: %v", err)
 		http.Error(w, "Failed to process order request", http.StatusInternalServerError)
 		return
@@ -92,6 +136,7 @@ func (h *ProductHandler) CreateOrders(w http.ResponseWriter, r *http.Request) {
 
 	response := map[string]interface{}{
 		"message":   "Orders created successfully",
+		"group_id":  groupID,
 		"order_ids": insertedOrderIDs,
 	}
 	w.Header().Set("Content-Type", "application/json")
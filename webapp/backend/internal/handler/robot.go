@@ -1,70 +1,228 @@
 package handler
 
 import (
+	"backend/internal/middleware"
 	"backend/internal/model"
 	"backend/internal/service"
-	"backend/internal/service/utils"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"regexp"
 	"strconv"
-	"time"
 )
 
+// ロボットIDが指定されなかった場合に使用するID (単一ロボット運用時との互換用)
+const defaultRobotID = "robot-001"
+
+// ステータス一括更新で一度に受け付ける最大件数
+const maxBatchStatusUpdates = 500
+
+var robotIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+var errInvalidRobotID = errors.New("robot ID must be 1-64 characters of [A-Za-z0-9_.-]")
+
+// リクエストからロボットIDを取得する
+// ロボットごとのキーで認証されていればそのロボットID、
+// そうでなければヘッダー X-ROBOT-ID、クエリパラメータ robot_id の順に参照する
+func robotIDFromRequest(r *http.Request) (string, error) {
+	if robotID, ok := middleware.GetRobotFromContext(r.Context()); ok {
+		return robotID, nil
+	}
+	robotID := r.Header.Get("X-ROBOT-ID")
+	if robotID == "" {
+		robotID = r.URL.Query().Get("robot_id")
+	}
+	if robotID == "" {
+		return defaultRobotID, nil
+	}
+	if !robotIDPattern.MatchString(robotID) {
+		return "", errInvalidRobotID
+	}
+	return robotID, nil
+}
+
 type RobotHandler struct {
 	RobotSvc *service.RobotService
+	streams  *robotStreams
 }
 
 func NewRobotHandler(robotSvc *service.RobotService) *RobotHandler {
-	return &RobotHandler{RobotSvc: robotSvc}
+	return &RobotHandler{RobotSvc: robotSvc, streams: newRobotStreams()}
 }
 
-// 配送計画を取得
-func (h *RobotHandler) GetDeliveryPlan(w http.ResponseWriter, r *http.Request) {
-	capacityStr := r.URL.Query().Get("capacity")
+// クエリパラメータから積載上限を取得する
+// capacity (重さ) は必須、max_volume (容積) と max_items (個数) は任意
+// 商品の容積は既定で 0 のため、DB で設定していなければ max_volume は計画に影響しない
+func capacityFromRequest(r *http.Request) (model.Capacity, error) {
+	var capacity model.Capacity
+	q := r.URL.Query()
+	capacityStr := q.Get("capacity")
 	if capacityStr == "" {
-		http.Error(w, "Query parameter 'capacity' is required", http.StatusBadRequest)
-		return
+		return capacity, errors.New("Query parameter 'capacity' is required")
 	}
-	capacity, err := strconv.Atoi(capacityStr)
+	var err error
+	capacity.Weight, err = strconv.Atoi(capacityStr)
+	if err != nil || capacity.Weight <= 0 {
+		return capacity, errors.New("Query parameter 'capacity' must be a positive integer")
+	}
+	if v := q.Get("max_volume"); v != "" {
+		capacity.Volume, err = strconv.Atoi(v)
+		if err != nil || capacity.Volume < 0 {
+			return capacity, errors.New("Query parameter 'max_volume' must be a non-negative integer")
+		}
+	}
+	if v := q.Get("max_items"); v != "" {
+		capacity.Items, err = strconv.Atoi(v)
+		if err != nil || capacity.Items < 0 {
+			return capacity, errors.New("Query parameter 'max_items' must be a non-negative integer")
+		}
+	}
+	return capacity, nil
+}
+
+// クエリパラメータ debug を取得する。指定がなければ false
+func debugFromRequest(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("debug")
+	if v == "" {
+		return false, nil
+	}
+	debug, err := strconv.ParseBool(v)
 	if err != nil {
-		http.Error(w, "Query parameter 'capacity' must be an integer", http.StatusBadRequest)
+		return false, errors.New("Query parameter 'debug' must be a boolean")
+	}
+	return debug, nil
+}
+
+// 注文の選択に使ったアルゴリズムと計算時間は従来のレスポンスに含まれないため、
+// strategy または debug が指定された場合のみ返す
+func omitOptimizerInfo(plan *model.DeliveryPlan, strategy string, debug bool) {
+	if strategy != "" || debug {
 		return
 	}
+	plan.Strategy = ""
+	plan.OptimizerTimeUs = 0
+}
 
-	ctx := r.Context()
+// 注文の実効優先度は従来のレスポンスに含まれないため、show が false の場合は返さない
+func omitPriorityInfo(plan *model.DeliveryPlan, show bool) {
+	if show {
+		return
+	}
+	for i := range plan.Orders {
+		plan.Orders[i].Priority = 0
+	}
+}
 
-	err = utils.WithTimeout(ctx, func(ctx context.Context) error {
-		for {
-			hasOrders, err := h.RobotSvc.HasShippingOrders(ctx)
-			if err != nil {
-				return err
-			}
-			if hasOrders {
-				break
-			}
+// 容積の合計は従来のレスポンスに含まれないため、max_volume が指定された場合のみ返す
+func omitVolumeInfo(plan *model.DeliveryPlan, capacity model.Capacity) {
+	if capacity.Volume == 0 {
+		plan.TotalVolume = 0
+	}
+}
 
-			select {
-			case <-ctx.Done():
-				log.Printf("Request cancelled while waiting for shipping orders: %v", ctx.Err())
-				return nil
-			case <-time.After(100 * time.Millisecond):
-			}
-		}
-		return nil
-	})
+// 配送計画を取得
+func (h *RobotHandler) GetDeliveryPlan(w http.ResponseWriter, r *http.Request) {
+	robotID, err := robotIDFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	capacity, err := capacityFromRequest(r)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 不正なパラメータで shipping の注文を待たないよう、待機の前に検証する
+	strategy := r.URL.Query().Get("strategy")
+	if err := h.RobotSvc.ValidateStrategy(strategy); err != nil {
+		http.Error(w, "Unknown strategy: "+strategy, http.StatusBadRequest)
+		return
+	}
+	granularity := r.URL.Query().Get("granularity")
+	if err := h.RobotSvc.ValidateGranularity(granularity); err != nil {
+		http.Error(w, "Unknown granularity: "+granularity, http.StatusBadRequest)
+		return
+	}
+	debug, err := debugFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hasOrders, err := h.RobotSvc.WaitForShippingOrders(r.Context())
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Printf("Request cancelled while waiting for shipping orders: %v", err)
+			return
+		}
 		log.Printf("Failed to check shipping orders: %v", err)
 		http.Error(w, "Failed to check shipping orders", http.StatusInternalServerError)
+		return
+	}
+	if !hasOrders {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
-	plan, err := h.RobotSvc.GenerateDeliveryPlan(r.Context(), "robot-001", capacity)
+	plan, err := h.RobotSvc.GenerateDeliveryPlan(r.Context(), robotID, capacity, strategy, granularity)
 	if err != nil {
+		if errors.Is(err, service.ErrUnknownOptimizer) {
+			http.Error(w, "Unknown strategy: "+strategy, http.StatusBadRequest)
+			return
+		}
 		log.Printf("Failed to generate delivery plan: %v", err)
 		http.Error(w, "Failed to create delivery plan", http.StatusInternalServerError)
 		return
 	}
+	omitOptimizerInfo(plan, strategy, debug)
+	omitVolumeInfo(plan, capacity)
+	omitPriorityInfo(plan, debug)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// 配送計画を試算する (注文は予約しない)
+func (h *RobotHandler) PreviewDeliveryPlan(w http.ResponseWriter, r *http.Request) {
+	robotID, err := robotIDFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	capacity, err := capacityFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	debug, err := debugFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	strategy := r.URL.Query().Get("strategy")
+	granularity := r.URL.Query().Get("granularity")
+	plan, err := h.RobotSvc.PreviewDeliveryPlan(r.Context(), robotID, capacity, strategy, granularity)
+	if err != nil {
+		if errors.Is(err, service.ErrUnknownOptimizer) {
+			http.Error(w, "Unknown strategy: "+strategy, http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, service.ErrUnknownGranularity) {
+			http.Error(w, "Unknown granularity: "+granularity, http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to preview delivery plan: %v", err)
+		http.Error(w, "Failed to preview delivery plan", http.StatusInternalServerError)
+		return
+	}
+	omitOptimizerInfo(plan, strategy, debug)
+	omitVolumeInfo(plan, capacity)
+	// 試算は優先度の確認に使うため、常に実効優先度を返す
+	omitPriorityInfo(plan, true)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(plan)
 }
@@ -79,11 +237,71 @@ func (h *RobotHandler) UpdateOrderStatus(w http.ResponseWriter, r *http.Request)
 
 	err := h.RobotSvc.UpdateOrderStatus(r.Context(), req.OrderID, req.NewStatus)
 	if err != nil {
-		log.Printf("Failed to update order status for order %d: %v", req.OrderID, err)
-		http.Error(w, "Failed to update order status", http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, service.ErrOrderNotFound):
+			http.Error(w, "Order not found", http.StatusNotFound)
+		case errors.Is(err, service.ErrUnknownStatus):
+			http.Error(w, "Unknown status: "+req.NewStatus, http.StatusBadRequest)
+		case errors.Is(err, service.ErrInvalidStatusTransition):
+			http.Error(w, "Status transition not allowed", http.StatusConflict)
+		default:
+			log.Printf("Failed to update order status for order %d: %v", req.OrderID, err)
+			http.Error(w, "Failed to update order status", http.StatusInternalServerError)
+		}
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Order status updated"))
 }
+
+// ロボットが現在配送中として保持している注文一覧を取得
+func (h *RobotHandler) GetRobotOrders(w http.ResponseWriter, r *http.Request) {
+	robotID, err := robotIDFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	orders, err := h.RobotSvc.GetRobotOrders(r.Context(), robotID)
+	if err != nil {
+		log.Printf("Failed to get orders for robot %s: %v", robotID, err)
+		http.Error(w, "Failed to get robot orders", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// 複数の注文ステータスを一括で更新
+// 注文ごとの結果を返し、一部が拒否されてもリクエスト全体は 200 となる
+func (h *RobotHandler) UpdateOrderStatuses(w http.ResponseWriter, r *http.Request) {
+	var req model.BatchUpdateOrderStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Updates) == 0 {
+		http.Error(w, "'updates' must not be empty", http.StatusBadRequest)
+		return
+	}
+	if len(req.Updates) > maxBatchStatusUpdates {
+		http.Error(w, fmt.Sprintf("'updates' must not exceed %d items", maxBatchStatusUpdates), http.StatusBadRequest)
+		return
+	}
+
+	results, err := h.RobotSvc.UpdateOrderStatuses(r.Context(), req.Updates)
+	if err != nil {
+		log.Printf("Failed to update order statuses: %v", err)
+		http.Error(w, "Failed to update order statuses", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Results []model.UpdateOrderStatusResult `json:"results"`
+	}{
+		Results: results,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type RobotCredentialHandler struct {
+	RobotCredSvc *service.RobotCredentialService
+}
+
+func NewRobotCredentialHandler(svc *service.RobotCredentialService) *RobotCredentialHandler {
+	return &RobotCredentialHandler{RobotCredSvc: svc}
+}
+
+func robotIDFromPath(r *http.Request) (string, error) {
+	robotID := chi.URLParam(r, "robotID")
+	if !robotIDPattern.MatchString(robotID) {
+		return "", errInvalidRobotID
+	}
+	return robotID, nil
+}
+
+// ロボットのAPIキー一覧を取得 (キー本体は含まない)
+func (h *RobotCredentialHandler) List(w http.ResponseWriter, r *http.Request) {
+	robotID, err := robotIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	creds, err := h.RobotCredSvc.List(r.Context(), robotID)
+	if err != nil {
+		log.Printf("Failed to list robot keys for %s: %v", robotID, err)
+		http.Error(w, "Failed to list robot keys", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Data []model.RobotCredential `json:"data"`
+	}{
+		Data: creds,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ロボットに新しいAPIキーを発行
+func (h *RobotCredentialHandler) Issue(w http.ResponseWriter, r *http.Request) {
+	robotID, err := robotIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	issued, err := h.RobotCredSvc.Issue(r.Context(), robotID)
+	if err != nil {
+		log.Printf("Failed to issue robot key for %s: %v", robotID, err)
+		http.Error(w, "Failed to issue robot key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(issued)
+}
+
+// ロボットのAPIキーをローテーション
+// 既存のキーは overlap_seconds の間だけ引き続き使える
+func (h *RobotCredentialHandler) Rotate(w http.ResponseWriter, r *http.Request) {
+	robotID, err := robotIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req model.RotateRobotKeyRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.OverlapSeconds < 0 {
+		http.Error(w, "overlap_seconds must be non-negative", http.StatusBadRequest)
+		return
+	}
+
+	issued, err := h.RobotCredSvc.Rotate(r.Context(), robotID, time.Duration(req.OverlapSeconds)*time.Second)
+	if err != nil {
+		log.Printf("Failed to rotate robot key for %s: %v", robotID, err)
+		http.Error(w, "Failed to rotate robot key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(issued)
+}
+
+// ロボットのAPIキーを即時に失効
+func (h *RobotCredentialHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	robotID, err := robotIDFromPath(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keyID := chi.URLParam(r, "keyID")
+
+	if err := h.RobotCredSvc.Revoke(r.Context(), robotID, keyID); err != nil {
+		if errors.Is(err, service.ErrRobotCredentialNotFound) {
+			http.Error(w, "Robot key not found or already revoked", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to revoke robot key %s for %s: %v", keyID, robotID, err)
+		http.Error(w, "Failed to revoke robot key", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
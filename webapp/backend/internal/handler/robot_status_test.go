@@ -0,0 +1,168 @@
+package handler
+
+import (
+	cache "backend/internal"
+	"backend/internal/model"
+	"backend/internal/repository"
+	"backend/internal/service"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 注文ステータスの更新で発行されるクエリだけを扱う DBTX
+// トランザクションを持たないため、キャッシュへの反映は各更新の直後に行われる
+type fakeStatusDB struct {
+	orders map[int64]model.Order
+	execs  []string
+}
+
+func (db *fakeStatusDB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return fmt.Errorf("unexpected query: %s", query)
+}
+
+func (db *fakeStatusDB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	switch {
+	case strings.Contains(query, "FROM orders") && strings.Contains(query, "FOR UPDATE"):
+		orders := dest.(*[]model.Order)
+		for _, arg := range args {
+			if o, ok := db.orders[arg.(int64)]; ok {
+				*orders = append(*orders, o)
+			}
+		}
+		sort.Slice(*orders, func(i, j int) bool { return (*orders)[i].OrderID < (*orders)[j].OrderID })
+		return nil
+	case strings.Contains(query, "FROM webhooks"):
+		return nil
+	}
+	return fmt.Errorf("unexpected query: %s", query)
+}
+
+func (db *fakeStatusDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	db.execs = append(db.execs, query)
+	return driver.RowsAffected(1), nil
+}
+
+func (db *fakeStatusDB) Rebind(query string) string { return query }
+
+func (db *fakeStatusDB) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	return nil, fmt.Errorf("unexpected query: %s", query)
+}
+
+// DB とキャッシュに同じ注文を用意する
+func setupStatusOrders(orders ...model.Order) *fakeStatusDB {
+	cache.Cache.ProductStock = make([]int, 2)
+	cache.Cache.ShippingOrderProductId = make(map[int64]int)
+	cache.Cache.RobotOrderIds = make(map[string]map[int64]struct{})
+	cache.Cache.UserOrders = make([][]model.Order, 2)
+	cache.Cache.OrderIdUserId = make(map[int64]struct {
+		UserID int
+		Index  int
+	})
+	db := &fakeStatusDB{orders: make(map[int64]model.Order)}
+	for _, o := range orders {
+		db.orders[o.OrderID] = o
+		cache.UpdateOrder(o)
+	}
+	return db
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	robot := sql.NullString{String: "robot-001", Valid: true}
+	shipping := model.Order{OrderID: 1, UserID: 1, ProductID: 1, Quantity: 1, ShippedStatus: "shipping", CreatedAt: time.Now()}
+	delivering := model.Order{OrderID: 2, UserID: 1, ProductID: 1, Quantity: 1, ShippedStatus: "delivering", RobotID: robot, CreatedAt: time.Now()}
+
+	tests := []struct {
+		name       string
+		orderID    int64
+		newStatus  string
+		wantCode   int
+		wantStatus string
+	}{
+		{"unknown order", 999, "completed", http.StatusNotFound, ""},
+		{"unknown status", 2, "lost", http.StatusBadRequest, "delivering"},
+		{"shipping to completed", 1, "completed", http.StatusConflict, "shipping"},
+		{"delivering to cancelled", 2, "cancelled", http.StatusConflict, "delivering"},
+		{"delivering to completed", 2, "completed", http.StatusOK, "completed"},
+		{"delivering to failed", 2, "failed", http.StatusOK, "failed"},
+		{"delivering back to shipping", 2, "shipping", http.StatusOK, "shipping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupStatusOrders(shipping, delivering)
+			h := NewRobotHandler(service.NewRobotService(repository.NewStore(db), service.RobotConfig{DefaultOptimizer: "dp"}))
+
+			body := fmt.Sprintf(`{"order_id": %d, "new_status": %q}`, tt.orderID, tt.newStatus)
+			req := httptest.NewRequest(http.MethodPatch, "/api/robot/orders/status", bytes.NewBufferString(body))
+			rec := httptest.NewRecorder()
+			h.UpdateOrderStatus(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status code = %d, want %d (body %q)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if tt.wantStatus == "" {
+				return
+			}
+			order, err := repository.NewStore(db).OrderRepo.FindByID(context.Background(), tt.orderID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.ShippedStatus != tt.wantStatus {
+				t.Errorf("shipped_status = %q, want %q", order.ShippedStatus, tt.wantStatus)
+			}
+			if tt.wantCode != http.StatusOK && len(db.execs) > 0 {
+				t.Errorf("rejected update executed queries: %v", db.execs)
+			}
+		})
+	}
+}
+
+// completed への遷移では到着日時が記録されること
+func TestUpdateOrderStatusCompletedSetsArrivedAt(t *testing.T) {
+	order := model.Order{OrderID: 1, UserID: 1, ProductID: 1, Quantity: 1, ShippedStatus: "delivering",
+		RobotID: sql.NullString{String: "robot-001", Valid: true}, CreatedAt: time.Now()}
+	db := setupStatusOrders(order)
+	h := NewRobotHandler(service.NewRobotService(repository.NewStore(db), service.RobotConfig{DefaultOptimizer: "dp"}))
+
+	before := time.Now()
+	req := httptest.NewRequest(http.MethodPatch, "/api/robot/orders/status", bytes.NewBufferString(`{"order_id": 1, "new_status": "completed"}`))
+	rec := httptest.NewRecorder()
+	h.UpdateOrderStatus(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d (body %q)", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	updated := false
+	for _, q := range db.execs {
+		if strings.HasPrefix(q, "UPDATE orders SET") {
+			updated = true
+			if !strings.Contains(q, "arrived_at = ?") {
+				t.Errorf("update query does not set arrived_at: %s", q)
+			}
+		}
+	}
+	if !updated {
+		t.Fatalf("orders were not updated: %v", db.execs)
+	}
+
+	got, err := repository.NewStore(db).OrderRepo.FindByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.ArrivedAt.Valid || got.ArrivedAt.Time.Before(before) {
+		t.Errorf("arrived_at = %+v, want a time after %v", got.ArrivedAt, before)
+	}
+	if got.RobotID.Valid {
+		if _, held := cache.Cache.RobotOrderIds[got.RobotID.String][got.OrderID]; held {
+			t.Errorf("completed order is still held by robot %s", got.RobotID.String)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// サーバーからのハートビート送信間隔
+	streamHeartbeatInterval = 15 * time.Second
+	// この時間ロボットから何も届かなければ切断したとみなす
+	streamReadTimeout  = 3 * streamHeartbeatInterval
+	streamWriteTimeout = 10 * time.Second
+)
+
+// ロボットIDごとの接続を管理する
+// 同じロボットが再接続した場合、古い接続は置き換えられて終了する
+type robotStreams struct {
+	mu    sync.Mutex
+	conns map[string]chan struct{}
+}
+
+func newRobotStreams() *robotStreams {
+	return &robotStreams{conns: make(map[string]chan struct{})}
+}
+
+// 接続を登録し、後続の接続に置き換えられたときに close されるチャネルと登録解除関数を返す
+func (s *robotStreams) register(robotID string) (<-chan struct{}, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.conns[robotID]; ok {
+		close(old)
+	}
+	superseded := make(chan struct{})
+	s.conns[robotID] = superseded
+	return superseded, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.conns[robotID] == superseded {
+			delete(s.conns, robotID)
+		}
+	}
+}
+
+// 配送計画をプッシュで受け取るための WebSocket ストリーム
+//
+// 接続直後に、ロボットが配送中として保持している注文を resume メッセージで送る。
+// 再接続時はこれを使って配送を継続できる (リース期限は接続とは独立して進む)。
+// ロボットが何も保持しておらず、shipping の注文が min_orders 件以上あれば
+// 配送計画を生成して plan メッセージで送る。配送結果は ack メッセージで報告する。
+// ロボットは streamReadTimeout 以内に何らかのメッセージ (heartbeat 等) を送ること。
+func (h *RobotHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	robotID, err := robotIDFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := streamOptions{
+		robotID:     robotID,
+		minOrders:   1,
+		strategy:    r.URL.Query().Get("strategy"),
+		granularity: r.URL.Query().Get("granularity"),
+	}
+	opts.capacity, err = capacityFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := r.URL.Query().Get("min_orders"); v != "" {
+		opts.minOrders, err = strconv.Atoi(v)
+		if err != nil || opts.minOrders <= 0 {
+			http.Error(w, "Query parameter 'min_orders' must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	opts.debug, err = debugFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.RobotSvc.ValidateStrategy(opts.strategy); err != nil {
+		http.Error(w, "Unknown strategy: "+opts.strategy, http.StatusBadRequest)
+		return
+	}
+	if err := h.RobotSvc.ValidateGranularity(opts.granularity); err != nil {
+		http.Error(w, "Unknown granularity: "+opts.granularity, http.StatusBadRequest)
+		return
+	}
+
+	server := websocket.Server{
+		// ロボットはブラウザではないため Origin を検証しない
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			h.serveStream(ws, opts)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+type streamOptions struct {
+	robotID     string
+	capacity    model.Capacity
+	minOrders   int
+	strategy    string
+	granularity string
+	debug       bool
+}
+
+func (h *RobotHandler) serveStream(ws *websocket.Conn, opts streamOptions) {
+	ctx := ws.Request().Context()
+	robotID := opts.robotID
+	superseded, unregister := h.streams.register(robotID)
+	defer unregister()
+	log.Printf("Robot %s connected to stream", robotID)
+	defer log.Printf("Robot %s disconnected from stream", robotID)
+
+	send := func(msg model.RobotStreamMessage) bool {
+		ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if err := websocket.JSON.Send(ws, msg); err != nil {
+			log.Printf("Failed to send %s to robot %s: %v", msg.Type, robotID, err)
+			return false
+		}
+		return true
+	}
+
+	// serveStream が戻ったことを読み込み側の goroutine に伝える
+	done := make(chan struct{})
+	defer close(done)
+	incoming := make(chan model.RobotStreamMessage)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			ws.SetReadDeadline(time.Now().Add(streamReadTimeout))
+			var msg model.RobotStreamMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			select {
+			case incoming <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	held, err := h.RobotSvc.GetRobotOrders(ctx, robotID)
+	if err != nil {
+		log.Printf("Failed to get orders for robot %s: %v", robotID, err)
+		return
+	}
+	if !send(model.RobotStreamMessage{Type: "resume", Orders: held.Orders}) {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	// 配送計画を作り直すのは、shipping の注文が増えたときと ack でロボットの保持する注文が変わったときのみ
+	// 通知を取りこぼさないよう、待機用のチャネルは計画を作る直前に取得し直す
+	var added <-chan struct{}
+	replan := true
+	for {
+		if replan {
+			replan = false
+			added = h.RobotSvc.ShippingOrdersAdded()
+			if plan, err := h.planIfIdle(ctx, opts); err != nil {
+				log.Printf("Failed to generate delivery plan for robot %s: %v", robotID, err)
+				return
+			} else if plan != nil && !send(model.RobotStreamMessage{Type: "plan", Plan: plan, PlanID: plan.PlanID}) {
+				h.releasePlan(ctx, plan)
+				return
+			}
+		}
+
+		select {
+		case <-added:
+			replan = true
+		case <-heartbeat.C:
+			if !send(model.RobotStreamMessage{Type: "heartbeat"}) {
+				return
+			}
+		case msg := <-incoming:
+			// heartbeat などは接続の維持のみが目的のため何もしない
+			if msg.Type != "ack" {
+				continue
+			}
+			result := model.RobotStreamMessage{Type: "ack_result", OrderID: msg.OrderID, NewStatus: msg.NewStatus}
+			if err := h.RobotSvc.UpdateOrderStatus(ctx, msg.OrderID, msg.NewStatus); err != nil {
+				result.Error = err.Error()
+			} else {
+				replan = true
+			}
+			if !send(result) {
+				return
+			}
+		case <-readerDone:
+			return
+		case <-superseded:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ロボットが注文を保持しておらず、shipping の注文が十分にあれば配送計画を生成する
+// 計画を送る必要がなければ nil を返す
+func (h *RobotHandler) planIfIdle(ctx context.Context, opts streamOptions) (*model.DeliveryPlan, error) {
+	held, err := h.RobotSvc.GetRobotOrders(ctx, opts.robotID)
+	if err != nil {
+		return nil, err
+	}
+	if len(held.Orders) > 0 {
+		return nil, nil
+	}
+	count, err := h.RobotSvc.CountShippingOrders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if count < opts.minOrders {
+		return nil, nil
+	}
+	plan, err := h.RobotSvc.GenerateDeliveryPlan(ctx, opts.robotID, opts.capacity, opts.strategy, opts.granularity)
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Orders) == 0 {
+		return nil, nil
+	}
+	omitOptimizerInfo(plan, opts.strategy, opts.debug)
+	omitVolumeInfo(plan, opts.capacity)
+	omitPriorityInfo(plan, opts.debug)
+	return plan, nil
+}
+
+// 送信できなかった配送計画の注文を、リース期限を待たずに shipping に戻す
+// 接続が切れていても解放できるよう、接続の context のキャンセルは引き継がない
+func (h *RobotHandler) releasePlan(ctx context.Context, plan *model.DeliveryPlan) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), streamWriteTimeout)
+	defer cancel()
+	if err := h.RobotSvc.ReleaseDeliveryPlan(ctx, plan); err != nil {
+		log.Printf("Failed to release undelivered plan for robot %s: %v", plan.RobotID, err)
+	}
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"backend/internal/repository"
+	"backend/internal/service"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// 送信一覧で一度に返す件数の既定値と上限
+const (
+	defaultWebhookDeliveryLimit = 100
+	maxWebhookDeliveryLimit     = 1000
+)
+
+type WebhookHandler struct {
+	WebhookSvc *service.WebhookService
+}
+
+func NewWebhookHandler(svc *service.WebhookService) *WebhookHandler {
+	return &WebhookHandler{WebhookSvc: svc}
+}
+
+// Webhook の送信先を登録し、署名の鍵を返す
+func (h *WebhookHandler) Register(w http.ResponseWriter, r *http.Request) {
+	var req model.RegisterWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	registered, err := h.WebhookSvc.Register(r.Context(), req.URL)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidWebhookURL) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to register webhook %s: %v", req.URL, err)
+		http.Error(w, "Failed to register webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(registered)
+}
+
+// Webhook の送信先一覧を取得 (署名の鍵は含まない)
+func (h *WebhookHandler) List(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := h.WebhookSvc.List(r.Context())
+	if err != nil {
+		log.Printf("Failed to list webhooks: %v", err)
+		http.Error(w, "Failed to list webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Data []model.Webhook `json:"data"`
+	}{
+		Data: webhooks,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Webhook の送信先を無効化
+func (h *WebhookHandler) Disable(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.ParseInt(chi.URLParam(r, "webhookID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.WebhookSvc.Disable(r.Context(), webhookID); err != nil {
+		if errors.Is(err, service.ErrWebhookNotFound) {
+			http.Error(w, "Webhook not found or already disabled", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to disable webhook %d: %v", webhookID, err)
+		http.Error(w, "Failed to disable webhook", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Webhook の送信一覧を取得
+// status を省略した場合は再送上限に達した (dead) 送信を返す
+func (h *WebhookHandler) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = repository.WebhookDeliveryDead
+	}
+	limit := defaultWebhookDeliveryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Query parameter 'limit' must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if limit > maxWebhookDeliveryLimit {
+			limit = maxWebhookDeliveryLimit
+		}
+	}
+
+	deliveries, err := h.WebhookSvc.ListDeliveries(r.Context(), status, limit)
+	if err != nil {
+		if errors.Is(err, service.ErrUnknownDeliveryStatus) {
+			http.Error(w, "Unknown status: "+status, http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to list webhook deliveries: %v", err)
+		http.Error(w, "Failed to list webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Data []model.WebhookDelivery `json:"data"`
+	}{
+		Data: deliveries,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// 再送上限に達した送信をもう一度送信する
+func (h *WebhookHandler) Replay(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := strconv.ParseInt(chi.URLParam(r, "deliveryID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.WebhookSvc.Replay(r.Context(), deliveryID); err != nil {
+		if errors.Is(err, service.ErrWebhookDeliveryNotFound) {
+			http.Error(w, "Webhook delivery not found or not dead", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to replay webhook delivery %d: %v", deliveryID, err)
+		http.Error(w, "Failed to replay webhook delivery", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -2,15 +2,22 @@ package middleware
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"log"
 	"net/http"
 
 	"backend/internal/repository"
+	"backend/internal/service"
+	"backend/pkg/robotauth"
 )
 
 type contextKey string
 
-const userContextKey contextKey = "user"
+const (
+	userContextKey  contextKey = "user"
+	robotContextKey contextKey = "robot"
+)
 
 func UserAuthMiddleware(sessionRepo *repository.SessionRepository) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -36,15 +43,72 @@ func UserAuthMiddleware(sessionRepo *repository.SessionRepository) func(http.Han
 	}
 }
 
-func RobotAuthMiddleware(validAPIKey string) func(http.Handler) http.Handler {
+// ロボットのリクエストを認証する
+// config.Mode により APIキー (X-API-KEY) と HMAC 署名のどちらで認証するかを選ぶ。
+// "both" の場合は X-SIGNATURE ヘッダーがあれば署名、なければAPIキーで認証する
+// ロボットごとに発行されたキーで認証された場合は、キーに紐づくロボットIDをコンテキストに格納する
+// 共有キー (config.LegacyAPIKey) の場合はロボットIDを特定できないため、X-ROBOT-ID ヘッダーの値がそのまま使われる
+func RobotAuthMiddleware(config RobotAuthConfig, credSvc *service.RobotCredentialService) func(http.Handler) http.Handler {
+	verifier := newSignatureVerifier(config, credSvc)
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			useSignature := config.Mode == RobotAuthModeHMAC ||
+				(config.Mode == RobotAuthModeBoth && r.Header.Get(robotauth.HeaderSignature) != "")
+			if useSignature {
+				robotID, perRobot, err := verifier.verify(w, r)
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					writeBodyError(w, err)
+					return
+				}
+				if err != nil {
+					http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+					return
+				}
+				if perRobot {
+					r = r.WithContext(context.WithValue(r.Context(), robotContextKey, robotID))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			apiKey := r.Header.Get("X-API-KEY")
+			if apiKey == "" {
+				http.Error(w, "Forbidden: Invalid or missing API key", http.StatusForbidden)
+				return
+			}
+			if config.LegacyAPIKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(config.LegacyAPIKey)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
 
-			if apiKey == "" || apiKey != validAPIKey {
+			robotID, ok := credSvc.Authenticate(r.Context(), apiKey)
+			if !ok {
 				http.Error(w, "Forbidden: Invalid or missing API key", http.StatusForbidden)
 				return
 			}
+			// 他のロボットになりすますことはできない
+			if h := r.Header.Get("X-ROBOT-ID"); h != "" && h != robotID {
+				http.Error(w, "Forbidden: API key does not belong to this robot", http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), robotContextKey, robotID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// 管理用APIのキーを検証する
+func AdminAuthMiddleware(adminAPIKey string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiKey := r.Header.Get("X-ADMIN-KEY")
+			if apiKey == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(adminAPIKey)) != 1 {
+				http.Error(w, "Forbidden: Invalid or missing admin key", http.StatusForbidden)
+				return
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -56,3 +120,10 @@ func GetUserFromContext(ctx context.Context) (int, bool) {
 	userID, ok := ctx.Value(userContextKey).(int)
 	return userID, ok
 }
+
+// コンテキストから認証済みのロボットIDを取得
+// ロボットIDはRobotAuthMiddlewareでロボットごとのキーが使われた場合のみ設定される
+func GetRobotFromContext(ctx context.Context) (string, bool) {
+	robotID, ok := ctx.Value(robotContextKey).(string)
+	return robotID, ok
+}
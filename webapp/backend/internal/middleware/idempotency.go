@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"backend/internal/utils"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// 冪等キーに対して保存したレスポンス
+type IdempotentResponse struct {
+	// キーの使い回しを検出するためのリクエスト内容のハッシュ
+	RequestHash string    `json:"request_hash"`
+	StatusCode  int       `json:"status_code"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	StoredAt    time.Time `json:"stored_at"`
+}
+
+// Idempotency-Key ヘッダー付きのリクエストの結果を保存し、同じキーで再送されたときは保存した結果を返す
+// キーはロボットごとに区別する。ヘッダーがないリクエストはそのまま処理する
+// 5xx のレスポンスは再試行できるよう保存しない。ttl を過ぎたキーは未使用として扱う
+// store が件数の上限で追い出す場合、ttl 内でも追い出されたキーは未使用として扱われる
+// 同じキーのリクエストが処理中であれば 409 を返す。複数のインスタンスで動かす場合は
+// インスタンス間で共有する locker (utils.NewRedisLocker) を渡すこと
+func IdempotencyMiddleware(store utils.Cache[string, IdempotentResponse], locker utils.Locker, ttl time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+				return
+			}
+			robotID, ok := GetRobotFromContext(r.Context())
+			if !ok {
+				robotID = r.Header.Get("X-ROBOT-ID")
+			}
+			storeKey := "idempotency:" + robotID + ":" + key
+
+			body, err := readBody(w, r)
+			if err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+			requestHash := hex.EncodeToString(sum[:])
+
+			unlock, ok, err := locker.TryLock(r.Context(), "idempotency-lock:"+robotID+":"+key)
+			if err != nil {
+				log.Printf("Failed to lock idempotency key: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "A request with this Idempotency-Key is already in progress", http.StatusConflict)
+				return
+			}
+			defer unlock()
+
+			stored, err := store.Get(r.Context(), storeKey)
+			if err != nil {
+				log.Printf("Failed to look up idempotency key: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if stored.Found && time.Since(stored.Value.StoredAt) < ttl {
+				if stored.Value.RequestHash != requestHash {
+					http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+					return
+				}
+				if stored.Value.ContentType != "" {
+					w.Header().Set("Content-Type", stored.Value.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.Value.StatusCode)
+				w.Write(stored.Value.Body)
+				return
+			}
+
+			rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			if rec.status >= 500 {
+				return
+			}
+			resp := IdempotentResponse{
+				RequestHash: requestHash,
+				StatusCode:  rec.status,
+				ContentType: w.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+				StoredAt:    time.Now(),
+			}
+			if err := store.Set(r.Context(), storeKey, resp); err != nil {
+				log.Printf("Failed to store idempotent response: %v", err)
+			}
+		})
+	}
+}
+
+// レスポンスを書き込みつつ、ステータスコードと本文を記録する
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"backend/internal/service"
+	"backend/internal/utils"
+	"backend/pkg/robotauth"
+)
+
+// ロボットの認証方式
+const (
+	RobotAuthModeKey  = "key"
+	RobotAuthModeHMAC = "hmac"
+	RobotAuthModeBoth = "both"
+)
+
+type RobotAuthConfig struct {
+	// RobotAuthModeKey, RobotAuthModeHMAC, RobotAuthModeBoth のいずれか
+	Mode string
+	// 全ロボット共通のAPIキー (空の場合は無効)
+	LegacyAPIKey string
+	// 署名のタイムスタンプとサーバー時刻のずれの許容範囲
+	MaxClockSkew time.Duration
+	// 使用済み nonce の記録先。MaxClockSkew の2倍の期間に受け付けるリクエスト数より大きくしておく
+	Nonces utils.Cache[string, int64]
+}
+
+var (
+	errMissingSignature = errors.New("missing signature headers")
+	errInvalidTimestamp = errors.New("invalid or expired timestamp")
+	errInvalidSignature = errors.New("invalid signature")
+	errNonceReused      = errors.New("nonce has already been used")
+	errNonceUnavailable = errors.New("failed to verify nonce")
+)
+
+type signatureVerifier struct {
+	config  RobotAuthConfig
+	credSvc *service.RobotCredentialService
+	// nonce の確認と記録をまとめて行うためのロック
+	nonceMu      sync.Mutex
+	legacyKey    string
+	hasLegacyKey bool
+}
+
+func newSignatureVerifier(config RobotAuthConfig, credSvc *service.RobotCredentialService) *signatureVerifier {
+	v := &signatureVerifier{config: config, credSvc: credSvc}
+	if config.LegacyAPIKey != "" {
+		// 共通キーはDBに保存しないため、キーそのものを署名鍵とする
+		v.legacyKey = config.LegacyAPIKey
+		v.hasLegacyKey = true
+	}
+	return v
+}
+
+// 署名付きリクエストを検証し、ロボットIDを返す
+// perRobot はロボットごとに発行されたキーで署名されていたかどうか
+func (v *signatureVerifier) verify(w http.ResponseWriter, r *http.Request) (robotID string, perRobot bool, err error) {
+	robotID = r.Header.Get(robotauth.HeaderRobotID)
+	timestamp := r.Header.Get(robotauth.HeaderTimestamp)
+	nonce := r.Header.Get(robotauth.HeaderNonce)
+	signature := r.Header.Get(robotauth.HeaderSignature)
+	if robotID == "" || timestamp == "" || nonce == "" || signature == "" {
+		return "", false, errMissingSignature
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", false, errInvalidTimestamp
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > v.config.MaxClockSkew {
+		return "", false, errInvalidTimestamp
+	}
+
+	body, err := readBody(w, r)
+	if err != nil {
+		return "", false, err
+	}
+	canonical := robotauth.CanonicalString(r.Method, r.URL.RequestURI(), robotID, timestamp, nonce, body)
+
+	matched := false
+	for _, key := range v.credSvc.SigningKeys(r.Context(), robotID) {
+		if signatureMatches(key, canonical, signature) {
+			matched, perRobot = true, true
+			break
+		}
+	}
+	if !matched && v.hasLegacyKey && signatureMatches(v.legacyKey, canonical, signature) {
+		matched = true
+	}
+	if !matched {
+		return "", false, errInvalidSignature
+	}
+
+	// 署名を検証してから nonce を記録し、不正なリクエストで記録先が埋まらないようにする
+	// ロボットIDを変えて再送されても検出できるよう、nonce はロボットIDに関係なく一度だけ使える
+	if err := v.useNonce(r.Context(), nonce, ts); err != nil {
+		return "", false, err
+	}
+	return robotID, perRobot, nil
+}
+
+func signatureMatches(key, canonical, signature string) bool {
+	return hmac.Equal([]byte(robotauth.Signature(key, canonical)), []byte(signature))
+}
+
+// nonce が未使用であれば使用済みとして記録する
+func (v *signatureVerifier) useNonce(ctx context.Context, key string, ts int64) error {
+	v.nonceMu.Lock()
+	defer v.nonceMu.Unlock()
+
+	seen, err := v.config.Nonces.Get(ctx, key)
+	if err != nil {
+		log.Printf("Failed to read nonce %s: %v", key, err)
+		return errNonceUnavailable
+	}
+	if seen.Found {
+		return errNonceReused
+	}
+	if err := v.config.Nonces.Set(ctx, key, ts); err != nil {
+		log.Printf("Failed to store nonce %s: %v", key, err)
+		return errNonceUnavailable
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 )
 
@@ -16,8 +17,18 @@ type Product struct {
 	Name        string `db:"name"         json:"name"`
 	Value       int    `db:"value"        json:"value"`
 	Weight      int    `db:"weight"       json:"weight"`
+	Volume      int    `db:"volume"       json:"-"`
 	Image       string `db:"image"        json:"image"`
 	Description string `db:"description"  json:"description"`
+	Stock       int    `db:"stock"        json:"-"`
+	InStock     bool   `db:"-"            json:"-"`
+}
+
+// 在庫数と在庫の有無を含む商品。商品一覧で in_stock_only または include_stock を指定した場合に返す
+type ProductWithStock struct {
+	Product
+	Stock   int  `json:"stock"`
+	InStock bool `json:"in_stock"`
 }
 
 type Order struct {
@@ -27,16 +38,226 @@ type Order struct {
 	ProductName   string       `db:"product_name"    json:"product_name"`
 	ShippedStatus string       `db:"shipped_status"  json:"shipped_status"`
 	Weight        int          `db:"weight"          json:"weight"`
+	Volume        int          `db:"volume"          json:"-"`
 	Value         int          `db:"value"           json:"value"`
 	CreatedAt     time.Time    `db:"created_at"      json:"created_at"`
 	ArrivedAt     sql.NullTime `db:"arrived_at"      json:"arrived_at"`
+	// 親注文のIDと明細の数量。配送計画に含まれる注文の Weight, Volume, Value は数量分の合計
+	// 従来の注文一覧には含まれないため、親注文ごとの一覧 (OrderGroupItem) と注文詳細でのみ返す
+	GroupID  int64 `db:"group_id" json:"-"`
+	Quantity int   `db:"quantity" json:"-"`
+	// 配送を担当しているロボットのID
+	RobotID sql.NullString `db:"robot_id" json:"-"`
+	// ロボットへの割り当て期限。期限までに完了報告がなければ shipping に戻る
+	LeaseExpiresAt sql.NullTime `db:"lease_expires_at" json:"-"`
+	// 配送計画での実効優先度と、期限超過により強制的に選ばれたか
+	// 実効優先度は配送計画の試算 (preview) と debug が指定された場合のみ返す
+	Priority int  `db:"-" json:"priority,omitempty"`
+	Overdue  bool `db:"-" json:"overdue,omitempty"`
+}
+
+// 親注文。1回の購入で注文された商品ごとの明細 (Order) をまとめる
+type OrderGroup struct {
+	GroupID   int64            `db:"group_id"   json:"group_id"`
+	UserID    int              `db:"user_id"    json:"user_id"`
+	CreatedAt time.Time        `db:"created_at" json:"created_at"`
+	Items     []OrderGroupItem `db:"-"          json:"items"`
+}
+
+// 親注文にまとめた明細
+type OrderGroupItem struct {
+	Order
+	GroupID  int64 `json:"group_id"`
+	Quantity int   `json:"quantity"`
+}
+
+// 注文ステータスの変更履歴
+type OrderStatusEvent struct {
+	OrderID   int64     `db:"order_id"   json:"-"`
+	Status    string    `db:"status"     json:"status"`
+	RobotID   *string   `db:"robot_id"   json:"robot_id,omitempty"`
+	ChangedAt time.Time `db:"changed_at" json:"changed_at"`
+}
+
+// 注文詳細。商品情報とステータスの変更履歴を含む
+type OrderDetail struct {
+	OrderID       int64              `json:"order_id"`
+	ShippedStatus string             `json:"shipped_status"`
+	GroupID       int64              `json:"group_id"`
+	Quantity      int                `json:"quantity"`
+	CreatedAt     time.Time          `json:"created_at"`
+	ArrivedAt     *time.Time         `json:"arrived_at"`
+	Product       Product            `json:"product"`
+	Timeline      []OrderStatusEvent `json:"timeline"`
+}
+
+// ロボットの積載上限
+// Weight は必須。Volume と Items は 0 のとき制限なしとして扱う
+// 商品の容積 (products.volume) は既定で 0 で、API からは設定できない。Volume の制限は
+// DB で商品の容積を設定した場合にのみ効く (キャッシュに読み込むため、反映にはサーバーの再起動が必要)
+type Capacity struct {
+	Weight int `json:"weight"`
+	Volume int `json:"volume"`
+	Items  int `json:"items"`
 }
 
 type DeliveryPlan struct {
-	RobotID     string  `json:"robot_id"`
-	TotalWeight int     `json:"total_weight"`
+	// 履歴として保存された計画のID。試算 (preview) では 0
+	// 配送計画のレスポンスには含めず、ストリームの plan メッセージと計画の履歴で返す
+	PlanID      int64  `json:"-"`
+	RobotID     string `json:"robot_id"`
+	TotalWeight int    `json:"total_weight"`
+	// max_volume が指定された場合のみ返す
+	TotalVolume int     `json:"total_volume,omitempty"`
 	TotalValue  int     `json:"total_value"`
 	Orders      []Order `json:"orders"`
+	// 注文の選択に使ったアルゴリズムと、その計算にかかった時間(マイクロ秒)
+	// strategy または debug が指定された場合のみ返す
+	// すべての注文が積載上限に収まりアルゴリズムを使わなかった場合は all、候補がなかった場合は none
+	Strategy        string `json:"strategy,omitempty"`
+	OptimizerTimeUs int64  `json:"optimizer_time_us,omitempty"`
+	// 試算 (preview) の場合のみ設定される
+	Stats *PlanStats `json:"stats,omitempty"`
+}
+
+// 配送計画の試算時の統計情報
+type PlanStats struct {
+	// 検討した shipping の注文数
+	Candidates int `json:"candidates"`
+	// 単体で積載上限に収まる注文数
+	Eligible int `json:"eligible"`
+	// 計画に含まれなかった注文の価値の合計
+	ValueLeftOnTable int `json:"value_left_on_table"`
+}
+
+// 配送計画の履歴
+type DeliveryPlanRecord struct {
+	PlanID         int64      `db:"plan_id"         json:"plan_id"`
+	RobotID        string     `db:"robot_id"        json:"robot_id"`
+	CapacityWeight int        `db:"capacity_weight" json:"capacity_weight"`
+	CapacityVolume int        `db:"capacity_volume" json:"capacity_volume"`
+	CapacityItems  int        `db:"capacity_items"  json:"capacity_items"`
+	TotalWeight    int        `db:"total_weight"    json:"total_weight"`
+	TotalVolume    int        `db:"total_volume"    json:"total_volume"`
+	TotalValue     int        `db:"total_value"     json:"total_value"`
+	Strategy       string     `db:"strategy"        json:"strategy"`
+	CreatedAt      time.Time  `db:"created_at"      json:"created_at"`
+	CompletedAt    *time.Time `db:"completed_at"    json:"completed_at"`
+	// 詳細取得時のみ設定される
+	Orders []DeliveryPlanOrder `db:"-" json:"orders,omitempty"`
+}
+
+// 配送計画に含まれた注文と、その配送結果
+// FinalStatus は配送中(delivering)を抜けた時点のステータス。リース切れの場合は expired、
+// 計画をロボットに送れずに解放した場合は released
+type DeliveryPlanOrder struct {
+	PlanID      int64      `db:"plan_id"      json:"-"`
+	OrderID     int64      `db:"order_id"     json:"order_id"`
+	FinalStatus *string    `db:"final_status" json:"final_status"`
+	CompletedAt *time.Time `db:"completed_at" json:"completed_at"`
+}
+
+// ロボットが現在配送中(delivering)として保持している注文
+type RobotOrders struct {
+	RobotID string  `json:"robot_id"`
+	Orders  []Order `json:"orders"`
+}
+
+// ロボット向けストリーム(/api/robot/stream)でやり取りするメッセージ
+// サーバー → ロボット: resume, plan, heartbeat, ack_result
+// ロボット → サーバー: ack, heartbeat
+type RobotStreamMessage struct {
+	Type      string        `json:"type"`
+	Plan      *DeliveryPlan `json:"plan,omitempty"`
+	PlanID    int64         `json:"plan_id,omitempty"`
+	Orders    []Order       `json:"orders,omitempty"`
+	OrderID   int64         `json:"order_id,omitempty"`
+	NewStatus string        `json:"new_status,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// ロボットのAPIキー。キー本体は保存せず SHA-256 ハッシュのみを保持する
+// HMAC 署名の鍵はハッシュとは別に、サーバーの秘密鍵から導出する
+// ExpiresAt はローテーションで置き換えられたキーの失効日時
+type RobotCredential struct {
+	KeyID     string     `db:"key_id"     json:"key_id"`
+	RobotID   string     `db:"robot_id"   json:"robot_id"`
+	KeyHash   string     `db:"key_hash"   json:"-"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	ExpiresAt *time.Time `db:"expires_at" json:"expires_at"`
+	RevokedAt *time.Time `db:"revoked_at" json:"revoked_at"`
+}
+
+// 発行したAPIキー。キー本体と署名鍵を返すのは発行時の一度だけ
+type IssuedRobotKey struct {
+	RobotCredential
+	APIKey string `json:"api_key"`
+	// HMAC 署名に使う鍵
+	SigningKey string `json:"signing_key"`
+}
+
+type RotateRobotKeyRequest struct {
+	// 既存のキーを引き続き使える猶予時間(秒)
+	OverlapSeconds int `json:"overlap_seconds"`
+}
+
+// 注文ステータスの変更を通知する Webhook の送信先
+// Secret は署名の鍵で、返すのは登録時の一度だけ
+type Webhook struct {
+	WebhookID int64     `db:"webhook_id" json:"webhook_id"`
+	URL       string    `db:"url"        json:"url"`
+	Secret    string    `db:"secret"     json:"-"`
+	Active    bool      `db:"active"     json:"active"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// 登録した Webhook。署名の鍵を含む
+type RegisteredWebhook struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+type RegisterWebhookRequest struct {
+	URL string `json:"url"`
+}
+
+// Webhook で送る注文ステータスの変更イベント
+// 同じ変更を複数の送信先に送る場合、EventID は共通になる
+type OrderStatusWebhookEvent struct {
+	EventID    string                 `json:"event_id"`
+	Type       string                 `json:"type"`
+	OccurredAt time.Time              `json:"occurred_at"`
+	Data       OrderStatusWebhookData `json:"data"`
+}
+
+type OrderStatusWebhookData struct {
+	OrderID   int64  `json:"order_id"`
+	UserID    int    `json:"user_id"`
+	GroupID   int64  `json:"group_id"`
+	ProductID int    `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	Status    string `json:"status"`
+	// 変更前のステータス。注文の作成時は空
+	PreviousStatus string `json:"previous_status,omitempty"`
+	RobotID        string `json:"robot_id,omitempty"`
+}
+
+// Webhook の送信1件 (outbox の行)
+type WebhookDelivery struct {
+	DeliveryID     int64           `db:"delivery_id"      json:"delivery_id"`
+	WebhookID      int64           `db:"webhook_id"       json:"webhook_id"`
+	URL            string          `db:"url"              json:"url"`
+	Secret         string          `db:"secret"           json:"-"`
+	Active         bool            `db:"active"           json:"-"`
+	EventID        string          `db:"event_id"         json:"event_id"`
+	Payload        json.RawMessage `db:"payload"          json:"payload"`
+	Status         string          `db:"status"           json:"status"`
+	Attempts       int             `db:"attempts"         json:"attempts"`
+	NextAttemptAt  time.Time       `db:"next_attempt_at"  json:"next_attempt_at"`
+	LastStatusCode *int            `db:"last_status_code" json:"last_status_code"`
+	LastError      *string         `db:"last_error"       json:"last_error"`
+	CreatedAt      time.Time       `db:"created_at"       json:"created_at"`
+	DeliveredAt    *time.Time      `db:"delivered_at"     json:"delivered_at"`
 }
 
 type LoginRequest struct {
@@ -53,11 +274,37 @@ type RequestItem struct {
 	Quantity  int `json:"quantity"`
 }
 
+// 注文リクエストの検証エラー
+// Index は items 内の位置で、リクエスト全体に対するエラーでは省略される
+// Available は在庫不足 (out_of_stock) の場合の現在の在庫数
+type OrderItemError struct {
+	Index     *int   `json:"index,omitempty"`
+	ProductID int    `json:"product_id,omitempty"`
+	Quantity  int    `json:"quantity,omitempty"`
+	Available *int   `json:"available,omitempty"`
+	Reason    string `json:"reason"`
+	Message   string `json:"message"`
+}
+
 type UpdateOrderStatusRequest struct {
 	OrderID   int64  `json:"order_id"`
 	NewStatus string `json:"new_status"`
 }
 
+// ステータスの一括更新リクエスト
+type BatchUpdateOrderStatusRequest struct {
+	Updates []UpdateOrderStatusRequest `json:"updates"`
+}
+
+// 一括更新における注文ごとの結果
+// Result は applied (適用済み), rejected (遷移が拒否された), not_found (注文が存在しない) のいずれか
+type UpdateOrderStatusResult struct {
+	OrderID   int64  `json:"order_id"`
+	NewStatus string `json:"new_status"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+}
+
 type ListRequest struct {
 	Search    string `json:"search"`
 	Type      string `json:"type"`
@@ -65,5 +312,59 @@ type ListRequest struct {
 	PageSize  int    `json:"page_size"`
 	SortField string `json:"sort_field"`
 	SortOrder string `json:"sort_order"`
-	Offset    int    `json:"-"`
+	// 注文履歴の絞り込み条件。いずれも指定がなければ絞り込まない
+	// 日時の範囲は From 以上 To 未満。到着日時で絞り込む場合、未到着の注文は含まない
+	ShippedStatuses []string   `json:"shipped_statuses"`
+	ProductIDs      []int      `json:"product_ids"`
+	CreatedFrom     *time.Time `json:"created_from"`
+	CreatedTo       *time.Time `json:"created_to"`
+	ArrivedFrom     *time.Time `json:"arrived_from"`
+	ArrivedTo       *time.Time `json:"arrived_to"`
+	// true の場合、注文履歴を親注文ごとにまとめて返す
+	Grouped bool `json:"grouped"`
+	// true の場合、在庫のある商品のみを返す
+	InStockOnly bool `json:"in_stock_only"`
+	// true の場合、商品の在庫数と在庫の有無も返す (InStockOnly の場合は常に返す)
+	IncludeStock bool `json:"include_stock"`
+	// 前回のレスポンスの next_cursor。指定された場合は Page の代わりにカーソルの続きから返す
+	Cursor string      `json:"cursor"`
+	Offset int         `json:"-"`
+	After  *ListCursor `json:"-"`
+}
+
+// 注文履歴のエクスポートの1行
+type OrderExportRow struct {
+	OrderID       int64      `json:"order_id"`
+	GroupID       int64      `json:"group_id"`
+	ProductID     int        `json:"product_id"`
+	ProductName   string     `json:"product_name"`
+	Quantity      int        `json:"quantity"`
+	ShippedStatus string     `json:"shipped_status"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ArrivedAt     *time.Time `json:"arrived_at"`
+}
+
+// ユーザーに配信する注文ステータスの変更
+type UserOrderEvent struct {
+	OrderID   int64  `json:"order_id"`
+	GroupID   int64  `json:"group_id"`
+	ProductID int    `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	Status    string `json:"status"`
+	// 変更前のステータス。注文の作成時は空
+	PreviousStatus string     `json:"previous_status,omitempty"`
+	ArrivedAt      *time.Time `json:"arrived_at"`
+	ChangedAt      time.Time  `json:"changed_at"`
+}
+
+// 一覧のページング位置。直前のページの最後の要素のソートキーとIDを保持する
+// ソートキーが同じ要素は ID の昇順に並ぶ
+type ListCursor struct {
+	Scope     string `json:"s"`
+	SortField string `json:"f"`
+	SortOrder string `json:"o"`
+	// 絞り込み条件と検索語のハッシュ。条件の異なる一覧にカーソルを使い回すことを防ぐ
+	FilterHash string `json:"h"`
+	Key        string `json:"k"`
+	ID         int64  `json:"i"`
 }
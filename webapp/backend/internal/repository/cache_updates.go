@@ -0,0 +1,53 @@
+package repository
+
+import (
+	cache "backend/internal"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// コミットとキャッシュへの反映をまとめて直列化する
+// 同じ注文を更新するトランザクションは行ロックで直列化されるが、コミット後の反映の順が入れ替わると
+// 新しい変更を古い変更で上書きしてしまうため、コミットした順にキャッシュへ反映する
+var commitMu sync.Mutex
+
+// DB の変更に合わせて行うキャッシュへの反映
+// トランザクション内ではロールバックされたときにキャッシュだけが変わらないよう、コミットが成功するまで遅らせる
+type cacheUpdates struct {
+	// true の場合、反映をコミットまで遅らせる
+	deferred bool
+	fns      []func()
+}
+
+// キャッシュへの反映を登録する。fn は cache.Cache.Order のロックを取得した状態で呼び出される
+// トランザクション外では即座に反映する
+func (u *cacheUpdates) add(fn func()) {
+	if u.deferred {
+		u.fns = append(u.fns, fn)
+		return
+	}
+	cache.Cache.Order.Lock()
+	defer cache.Cache.Order.Unlock()
+	fn()
+}
+
+// トランザクションをコミットし、成功した場合のみ遅らせていた反映を行う
+func (u *cacheUpdates) commit(tx *sqlx.Tx) error {
+	if len(u.fns) == 0 {
+		return tx.Commit()
+	}
+	commitMu.Lock()
+	defer commitMu.Unlock()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	cache.Cache.Order.Lock()
+	defer cache.Cache.Order.Unlock()
+	for _, fn := range u.fns {
+		fn()
+	}
+	u.fns = nil
+	return nil
+}
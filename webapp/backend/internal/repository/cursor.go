@@ -0,0 +1,229 @@
+package repository
+
+import (
+	"backend/internal/model"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// カーソルがどの一覧のものかを表す
+const (
+	OrderCursorScope   = "orders"
+	ProductCursorScope = "products"
+)
+
+func normalizeSortOrder(order string) string {
+	if strings.ToUpper(order) == "DESC" {
+		return "desc"
+	}
+	return "asc"
+}
+
+// カーソルがこの一覧とソート条件、絞り込み条件に対して発行されたものか
+func CursorMatches(c model.ListCursor, scope string, req model.ListRequest) bool {
+	return c.Scope == scope && c.SortField == req.SortField && c.SortOrder == normalizeSortOrder(req.SortOrder) &&
+		c.FilterHash == listFilterHash(req)
+}
+
+// 一覧の結果に影響する絞り込み条件と検索語のハッシュ
+// 指定の順序や重複、タイムゾーンの違いで同じ条件が別のハッシュにならないよう正規化してから計算する
+func listFilterHash(req model.ListRequest) string {
+	normalizeTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	statuses := slices.Compact(slices.Sorted(slices.Values(req.ShippedStatuses)))
+	productIDs := slices.Compact(slices.Sorted(slices.Values(req.ProductIDs)))
+	filter := struct {
+		Search          string   `json:"search"`
+		Type            string   `json:"type"`
+		ShippedStatuses []string `json:"shipped_statuses"`
+		ProductIDs      []int    `json:"product_ids"`
+		CreatedFrom     string   `json:"created_from"`
+		CreatedTo       string   `json:"created_to"`
+		ArrivedFrom     string   `json:"arrived_from"`
+		ArrivedTo       string   `json:"arrived_to"`
+		Grouped         bool     `json:"grouped"`
+		InStockOnly     bool     `json:"in_stock_only"`
+	}{
+		Search:          req.Search,
+		Type:            req.Type,
+		ShippedStatuses: statuses,
+		ProductIDs:      productIDs,
+		CreatedFrom:     normalizeTime(req.CreatedFrom),
+		CreatedTo:       normalizeTime(req.CreatedTo),
+		ArrivedFrom:     normalizeTime(req.ArrivedFrom),
+		ArrivedTo:       normalizeTime(req.ArrivedTo),
+		Grouped:         req.Grouped,
+		InStockOnly:     req.InStockOnly,
+	}
+	b, _ := json.Marshal(filter)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
+
+// ソートキーが同じ要素は ID の昇順に並べ、ページの境界が一意に定まるようにする
+func thenByID[T any](less func(a, b T) bool, id func(T) int64) func(a, b T) bool {
+	return func(a, b T) bool {
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return id(a) < id(b)
+	}
+}
+
+// pivot があれば pivot より後ろの要素を先頭から size 件、なければ page ページ目を返す
+func pageAfter[T any](arr []T, less func(a, b T) bool, pivot *T, page, size int) []T {
+	if pivot == nil {
+		return PageStable(arr, less, page, size)
+	}
+	rest := make([]T, 0, len(arr))
+	for _, v := range arr {
+		if less(*pivot, v) {
+			rest = append(rest, v)
+		}
+	}
+	return PageStable(rest, less, 1, size)
+}
+
+func orderSortKey(o model.Order, field string) string {
+	switch field {
+	case "product_name":
+		return o.ProductName
+	case "created_at":
+		return o.CreatedAt.Format(time.RFC3339Nano)
+	case "shipped_status":
+		return o.ShippedStatus
+	case "arrived_at":
+		if o.ArrivedAt.Valid {
+			return o.ArrivedAt.Time.Format(time.RFC3339Nano)
+		}
+	}
+	return ""
+}
+
+// カーソルの位置にある注文を、ソートに使うフィールドだけ埋めて復元する
+func orderFromCursor(c model.ListCursor) (model.Order, error) {
+	o := model.Order{OrderID: c.ID}
+	switch c.SortField {
+	case "product_name":
+		o.ProductName = c.Key
+	case "created_at":
+		t, err := time.Parse(time.RFC3339Nano, c.Key)
+		if err != nil {
+			return o, err
+		}
+		o.CreatedAt = t
+	case "shipped_status":
+		o.ShippedStatus = c.Key
+	case "arrived_at":
+		if c.Key != "" {
+			t, err := time.Parse(time.RFC3339Nano, c.Key)
+			if err != nil {
+				return o, err
+			}
+			o.ArrivedAt = sql.NullTime{Time: t, Valid: true}
+		}
+	}
+	return o, nil
+}
+
+// ページが埋まっていれば、最後の注文の位置を次のページのカーソルとして返す
+func NextOrderCursor(orders []model.Order, req model.ListRequest) *model.ListCursor {
+	if len(orders) == 0 || len(orders) < req.PageSize {
+		return nil
+	}
+	last := orders[len(orders)-1]
+	return &model.ListCursor{
+		Scope:      OrderCursorScope,
+		SortField:  req.SortField,
+		SortOrder:  normalizeSortOrder(req.SortOrder),
+		FilterHash: listFilterHash(req),
+		Key:        orderSortKey(last, req.SortField),
+		ID:         last.OrderID,
+	}
+}
+
+// 商品一覧でソートに使える列。それ以外が指定された場合は product_id でソートする
+var productSortColumns = map[string]bool{
+	"product_id":  true,
+	"name":        true,
+	"value":       true,
+	"weight":      true,
+	"volume":      true,
+	"image":       true,
+	"description": true,
+}
+
+func productSortColumn(field string) string {
+	if productSortColumns[field] {
+		return field
+	}
+	return "product_id"
+}
+
+func productSortKey(p model.Product, field string) string {
+	switch productSortColumn(field) {
+	case "name":
+		return p.Name
+	case "description":
+		return p.Description
+	case "image":
+		return p.Image
+	case "value":
+		return strconv.Itoa(p.Value)
+	case "weight":
+		return strconv.Itoa(p.Weight)
+	case "volume":
+		return strconv.Itoa(p.Volume)
+	}
+	return ""
+}
+
+// カーソルの位置にある商品を、ソートに使うフィールドだけ埋めて復元する
+func productFromCursor(c model.ListCursor) (model.Product, error) {
+	p := model.Product{ProductID: int(c.ID)}
+	var err error
+	switch productSortColumn(c.SortField) {
+	case "name":
+		p.Name = c.Key
+	case "description":
+		p.Description = c.Key
+	case "image":
+		p.Image = c.Key
+	case "value":
+		p.Value, err = strconv.Atoi(c.Key)
+	case "weight":
+		p.Weight, err = strconv.Atoi(c.Key)
+	case "volume":
+		p.Volume, err = strconv.Atoi(c.Key)
+	}
+	return p, err
+}
+
+// ページが埋まっていれば、最後の商品の位置を次のページのカーソルとして返す
+func NextProductCursor(products []model.Product, req model.ListRequest) *model.ListCursor {
+	if len(products) == 0 || len(products) < req.PageSize {
+		return nil
+	}
+	last := products[len(products)-1]
+	return &model.ListCursor{
+		Scope:      ProductCursorScope,
+		SortField:  req.SortField,
+		SortOrder:  normalizeSortOrder(req.SortOrder),
+		FilterHash: listFilterHash(req),
+		Key:        productSortKey(last, req.SortField),
+		ID:         int64(last.ProductID),
+	}
+}
@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"backend/internal/model"
+	"testing"
+	"time"
+)
+
+func TestCursorMatchesFilters(t *testing.T) {
+	from := time.Date(2026, 1, 1, 9, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+	base := model.ListRequest{
+		Search:          "apple",
+		Type:            "partial",
+		PageSize:        1,
+		SortField:       "created_at",
+		SortOrder:       "DESC",
+		ShippedStatuses: []string{"shipping", "completed"},
+		ProductIDs:      []int{3, 1},
+		CreatedFrom:     &from,
+	}
+	cursor := NextOrderCursor([]model.Order{{OrderID: 1, CreatedAt: from}}, base)
+	if cursor == nil {
+		t.Fatal("NextOrderCursor returned nil for a full page")
+	}
+
+	fromUTC := from.UTC()
+	tests := []struct {
+		name   string
+		modify func(req *model.ListRequest)
+		want   bool
+	}{
+		{"same request", func(req *model.ListRequest) {}, true},
+		{"reordered and duplicated filters", func(req *model.ListRequest) {
+			req.ShippedStatuses = []string{"completed", "shipping", "shipping"}
+			req.ProductIDs = []int{1, 3}
+		}, true},
+		{"same time in another zone", func(req *model.ListRequest) { req.CreatedFrom = &fromUTC }, true},
+		{"different search", func(req *model.ListRequest) { req.Search = "banana" }, false},
+		{"different search type", func(req *model.ListRequest) { req.Type = "prefix" }, false},
+		{"different statuses", func(req *model.ListRequest) { req.ShippedStatuses = []string{"shipping"} }, false},
+		{"different products", func(req *model.ListRequest) { req.ProductIDs = nil }, false},
+		{"different date range", func(req *model.ListRequest) { req.CreatedFrom = nil }, false},
+		{"different sort order", func(req *model.ListRequest) { req.SortOrder = "ASC" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := base
+			tt.modify(&req)
+			if got := CursorMatches(*cursor, OrderCursorScope, req); got != tt.want {
+				t.Errorf("CursorMatches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if CursorMatches(*cursor, ProductCursorScope, base) {
+		t.Error("order cursor matched the product list")
+	}
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"backend/internal/model"
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type DeliveryPlanRepository struct {
+	db DBTX
+}
+
+func NewDeliveryPlanRepository(db DBTX) *DeliveryPlanRepository {
+	return &DeliveryPlanRepository{db: db}
+}
+
+// 配送計画を履歴として保存し、採番された計画IDを返す
+func (r *DeliveryPlanRepository) Create(ctx context.Context, plan *model.DeliveryPlan, capacity model.Capacity, createdAt time.Time) (int64, error) {
+	query := `
+		INSERT INTO delivery_plans
+			(robot_id, capacity_weight, capacity_volume, capacity_items, total_weight, total_volume, total_value, strategy, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := r.db.ExecContext(ctx, query,
+		plan.RobotID, capacity.Weight, capacity.Volume, capacity.Items,
+		plan.TotalWeight, plan.TotalVolume, plan.TotalValue, plan.Strategy, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	planID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(plan.Orders) > 0 {
+		rows := make([]model.DeliveryPlanOrder, len(plan.Orders))
+		for i, order := range plan.Orders {
+			rows[i] = model.DeliveryPlanOrder{PlanID: planID, OrderID: order.OrderID}
+		}
+		_, err = r.db.NamedExecContext(ctx, `INSERT INTO delivery_plan_orders (plan_id, order_id) VALUES (:plan_id, :order_id)`, rows)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return planID, nil
+}
+
+// 配送中の注文の配送結果を記録する
+// すべての注文の結果が揃った計画は完了日時を記録する
+func (r *DeliveryPlanRepository) FinishOrders(ctx context.Context, orderIDs []int64, finalStatus string, finishedAt time.Time) error {
+	if len(orderIDs) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In(`
+		UPDATE delivery_plan_orders SET final_status = ?, completed_at = ?
+		WHERE order_id IN (?) AND completed_at IS NULL`, finalStatus, finishedAt, orderIDs)
+	if err != nil {
+		return err
+	}
+	if _, err := r.db.ExecContext(ctx, r.db.Rebind(query), args...); err != nil {
+		return err
+	}
+
+	query, args, err = sqlx.In(`
+		UPDATE delivery_plans p SET completed_at = ?
+		WHERE p.completed_at IS NULL
+		  AND p.plan_id IN (SELECT plan_id FROM delivery_plan_orders WHERE order_id IN (?))
+		  AND NOT EXISTS (
+			SELECT 1 FROM delivery_plan_orders o WHERE o.plan_id = p.plan_id AND o.completed_at IS NULL
+		  )`, finishedAt, orderIDs)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, r.db.Rebind(query), args...)
+	return err
+}
+
+// 配送計画の履歴を新しい順に取得
+// robotID が空なら全ロボットが対象。beforeID が 0 より大きければそれより古い計画のみ返す
+func (r *DeliveryPlanRepository) List(ctx context.Context, robotID string, beforeID int64, limit int) ([]model.DeliveryPlanRecord, error) {
+	query := `SELECT * FROM delivery_plans WHERE 1 = 1`
+	args := []interface{}{}
+	if robotID != "" {
+		query += ` AND robot_id = ?`
+		args = append(args, robotID)
+	}
+	if beforeID > 0 {
+		query += ` AND plan_id < ?`
+		args = append(args, beforeID)
+	}
+	query += ` ORDER BY plan_id DESC LIMIT ?`
+	args = append(args, limit)
+
+	plans := make([]model.DeliveryPlanRecord, 0, limit)
+	if err := r.db.SelectContext(ctx, &plans, query, args...); err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// 配送計画の履歴を、含まれる注文の配送結果とともに取得
+func (r *DeliveryPlanRepository) FindByID(ctx context.Context, planID int64) (*model.DeliveryPlanRecord, error) {
+	var plan model.DeliveryPlanRecord
+	if err := r.db.GetContext(ctx, &plan, `SELECT * FROM delivery_plans WHERE plan_id = ?`, planID); err != nil {
+		return nil, err
+	}
+	plan.Orders = make([]model.DeliveryPlanOrder, 0)
+	err := r.db.SelectContext(ctx, &plan.Orders, `SELECT * FROM delivery_plan_orders WHERE plan_id = ? ORDER BY order_id`, planID)
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
@@ -4,20 +4,24 @@ import (
 	cache "backend/internal"
 	"backend/internal/model"
 	"context"
+	"database/sql"
 	"fmt"
+	"log"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/samber/lo"
 )
 
 type OrderRepository struct {
-	db DBTX
+	db           DBTX
+	cacheUpdates *cacheUpdates
 }
 
 func NewOrderRepository(db DBTX) *OrderRepository {
-	return &OrderRepository{db: db}
+	return &OrderRepository{db: db, cacheUpdates: &cacheUpdates{}}
 }
 
 // 注文を作成し、生成された注文IDを返す
@@ -34,41 +38,221 @@ func (r *OrderRepository) Create(ctx context.Context, order *model.Order) (strin
 	return fmt.Sprintf("%d", id), nil
 }
 
+// 注文 (明細) をまとめて作成し、生成された注文IDを返す
+// 注文はすべて同じユーザーのもので、1つの親注文にまとめられる (GroupID に設定される)
+// 在庫が足りない商品があれば *OutOfStockError を返す。トランザクション内で呼び出すこと
 func (r *OrderRepository) CreateMany(ctx context.Context, orders []*model.Order) ([]string, error) {
-	var idStart int64
+	// 在庫の確保は注文の作成と同じトランザクションで行う
+	quantities := make(map[int]int)
+	for _, order := range orders {
+		if order.Quantity <= 0 {
+			order.Quantity = 1
+		}
+		quantities[order.ProductID] += order.Quantity
+	}
+	if err := decrementStock(ctx, r.db, quantities); err != nil {
+		return nil, err
+	}
 
-	cache.Cache.Order.Lock()
-	defer cache.Cache.Order.Unlock()
-	// TODO: トランザクション貼らないとまずいかも
-	err := r.db.GetContext(ctx, &idStart, "SELECT `AUTO_INCREMENT` FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_NAME = 'orders'")
+	now := time.Now().Truncate(time.Second)
+	// 同時に作成する注文 (明細) は1つの親注文にまとめる
+	result, err := r.db.ExecContext(ctx, "INSERT INTO order_groups (user_id, created_at) VALUES (?, ?)", orders[0].UserID, now)
+	if err != nil {
+		return nil, err
+	}
+	groupID, err := result.LastInsertId()
 	if err != nil {
 		return nil, err
 	}
+	for _, order := range orders {
+		order.GroupID = groupID
+		order.ShippedStatus = "shipping"
+		order.CreatedAt = now
+	}
 
-	query := `INSERT INTO orders (user_id, product_id, shipped_status, created_at) VALUES (:user_id, :product_id, 'shipping', NOW())`
-	_, err = r.db.NamedExecContext(ctx, query, orders)
+	query := `INSERT INTO orders (user_id, product_id, group_id, quantity, shipped_status, created_at) VALUES (:user_id, :product_id, :group_id, :quantity, :shipped_status, :created_at)`
+	result, err = r.db.NamedExecContext(ctx, query, orders)
+	if err != nil {
+		return nil, err
+	}
+	inserted, err := result.RowsAffected()
 	if err != nil {
 		return nil, err
 	}
+	if inserted != int64(len(orders)) {
+		return nil, fmt.Errorf("inserted %d orders, expected %d", inserted, len(orders))
+	}
 
-	idLast := idStart + int64(len(orders)) - 1
+	// 一括 INSERT の注文IDは、innodb_autoinc_lock_mode=2 (MySQL 8 以降の既定) では
+	// 他の INSERT と並行すると連番にならないため、LastInsertId からは求めない
+	// 親注文はこの呼び出しだけが作成したものなので、親注文IDで読み直せば正確な注文IDが得られる
+	// 1つの INSERT 文の中では行の順に増加するIDが振られるため、ID順に並べると orders と同じ順になる
+	orderIDs := make([]int64, 0, len(orders))
+	if err := r.db.SelectContext(ctx, &orderIDs, "SELECT order_id FROM orders WHERE group_id = ? ORDER BY order_id", groupID); err != nil {
+		return nil, err
+	}
+	if len(orderIDs) != len(orders) {
+		return nil, fmt.Errorf("found %d orders in group %d, expected %d", len(orderIDs), groupID, len(orders))
+	}
+	ids := make([]string, len(orders))
+	for i, orderId := range orderIDs {
+		ids[i] = fmt.Sprintf("%d", orderId)
+		orders[i].OrderID = orderId
+	}
+	if err := insertStatusHistory(ctx, r.db, orderIDs, "shipping", sql.NullString{}, now); err != nil {
+		return nil, err
+	}
+	events := make([]model.OrderStatusWebhookEvent, len(orders))
+	for i, order := range orders {
+		events[i] = newStatusWebhookEvent(*order, "", "shipping", sql.NullString{}, now)
+	}
+	if err := enqueueStatusWebhooks(ctx, r.db, events); err != nil {
+		return nil, err
+	}
 
-	ids := make([]string, idLast-idStart+1)
-	for i := idStart; i <= idLast; i++ {
-		ids[i-idStart] = fmt.Sprintf("%d", i)
-		cache.UpdateOrder(*orders[i-idStart])
+	// 注文と在庫のキャッシュへの反映、ユーザーへの配信、待機中のロボットへの通知はコミット後に行う
+	created := make([]model.Order, len(orders))
+	for i, order := range orders {
+		created[i] = *order
+	}
+	for productID, q := range quantities {
+		quantities[productID] = -q
 	}
+	r.cacheUpdates.add(func() {
+		for _, order := range created {
+			cache.UpdateOrder(order)
+		}
+		applyStockLocked(quantities)
+		cache.ShippingOrdersNotifier.Notify()
+	})
 
 	return ids, nil
 }
 
+// 行ロックを取って読み出す注文のカラム
+const lockedOrderColumns = "order_id, user_id, product_id, group_id, quantity, shipped_status, created_at, arrived_at, robot_id, lease_expires_at"
+
+// 注文を行ロックを取って DB から取得する。存在しない注文は含まれない
+// ステータスの検証はキャッシュではなくこの結果に対して行い、確定までの間に他の更新と競合しないようにする
+// トランザクション内で呼び出すこと
+func (r *OrderRepository) lockOrders(ctx context.Context, orderIDs []int64) ([]model.Order, error) {
+	orders := make([]model.Order, 0, len(orderIDs))
+	if len(orderIDs) == 0 {
+		return orders, nil
+	}
+	// 複数の更新が同時に行ロックを取ってもデッドロックしないよう、常に注文ID順に取得する
+	query, args, err := sqlx.In("SELECT "+lockedOrderColumns+" FROM orders WHERE order_id IN (?) ORDER BY order_id FOR UPDATE", orderIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.db.SelectContext(ctx, &orders, r.db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// DB で更新した注文をキャッシュに反映する。cacheUpdates に登録し、コミット後に呼び出す
+// before は更新前に DB から読んだ注文で、キャッシュ上のステータスがそれと異なる場合は
+// キャッシュがすでに別の変更を反映しているため上書きしない
+// 呼び出し元で cache.Cache.Order のロックを取得していること
+func applyOrderLocked(before, after model.Order) {
+	if e, ok := cache.Cache.OrderIdUserId[after.OrderID]; ok {
+		if current := cache.Cache.UserOrders[e.UserID][e.Index]; current.ShippedStatus != before.ShippedStatus {
+			log.Printf("Skipped cache update for order %d: cached status is %q, expected %q", after.OrderID, current.ShippedStatus, before.ShippedStatus)
+			return
+		}
+	}
+	cache.UpdateOrder(after)
+}
+
 // 複数の注文IDのステータスを一括で更新
 // 主に配送ロボットが注文を引き受けた際に一括更新をするために使用
 func (r *OrderRepository) UpdateStatuses(ctx context.Context, orderIDs []int64, newStatus string) error {
-	if len(orderIDs) == 0 {
+	orders, err := r.lockOrders(ctx, orderIDs)
+	if err != nil {
+		return err
+	}
+	return r.updateStatuses(ctx, orders, newStatus)
+}
+
+// 注文ステータスを一括で遷移させる
+// 現在の注文を check で検証し、nil が返ったものだけを更新する
+// 戻り値は注文IDごとの結果で、nil は適用済み、存在しない注文は sql.ErrNoRows となる
+// トランザクション内で呼び出すこと
+func (r *OrderRepository) TransitionStatuses(ctx context.Context, orderIDs []int64, newStatus string, check func(current model.Order) error) (map[int64]error, error) {
+	newStatuses := make(map[int64]string, len(orderIDs))
+	for _, orderId := range orderIDs {
+		newStatuses[orderId] = newStatus
+	}
+	return r.TransitionStatusesTo(ctx, newStatuses, func(current model.Order, _ string) error {
+		return check(current)
+	})
+}
+
+// 注文ごとに遷移先を指定して、注文ステータスを一括で遷移させる
+// 対象の注文はまとめて行ロックを取るため、遷移先の異なる注文を含む更新どうしでもデッドロックしない
+// 検証と戻り値は TransitionStatuses と同じ。トランザクション内で呼び出すこと
+func (r *OrderRepository) TransitionStatusesTo(ctx context.Context, newStatuses map[int64]string, check func(current model.Order, newStatus string) error) (map[int64]error, error) {
+	orderIDs := make([]int64, 0, len(newStatuses))
+	for orderId := range newStatuses {
+		orderIDs = append(orderIDs, orderId)
+	}
+	orders, err := r.lockOrders(ctx, orderIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[int64]error, len(orderIDs))
+	for _, orderId := range orderIDs {
+		results[orderId] = sql.ErrNoRows
+	}
+	groups := make(map[string][]model.Order)
+	statuses := make([]string, 0)
+	for _, order := range orders {
+		newStatus := newStatuses[order.OrderID]
+		if err := check(order, newStatus); err != nil {
+			results[order.OrderID] = err
+			continue
+		}
+		results[order.OrderID] = nil
+		if _, ok := groups[newStatus]; !ok {
+			statuses = append(statuses, newStatus)
+		}
+		groups[newStatus] = append(groups[newStatus], order)
+	}
+	for _, newStatus := range statuses {
+		if err := r.updateStatuses(ctx, groups[newStatus], newStatus); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// ステータスを更新し、遷移先に応じて付随するカラムも更新する
+// shipping に戻る場合はロボットの割り当てを外し、completed の場合は到着日時を記録し、cancelled の場合は在庫を戻す
+// orders は lockOrders で取得した更新前の注文で、キャッシュへの反映はトランザクションのコミット後に行う
+func (r *OrderRepository) updateStatuses(ctx context.Context, orders []model.Order, newStatus string) error {
+	if len(orders) == 0 {
 		return nil
 	}
-	query, args, err := sqlx.In("UPDATE orders SET shipped_status = ? WHERE order_id IN (?)", newStatus, orderIDs)
+	now := time.Now()
+	orderIDs := make([]int64, len(orders))
+	for i, order := range orders {
+		orderIDs[i] = order.OrderID
+	}
+
+	sets := "shipped_status = ?, lease_expires_at = NULL"
+	args := []interface{}{newStatus}
+	switch newStatus {
+	case "shipping":
+		sets += ", robot_id = NULL"
+	case "completed":
+		sets += ", arrived_at = ?"
+		args = append(args, now)
+	}
+	args = append(args, orderIDs)
+
+	query, args, err := sqlx.In("UPDATE orders SET "+sets+" WHERE order_id IN (?)", args...)
 	if err != nil {
 		return err
 	}
@@ -77,15 +261,235 @@ func (r *OrderRepository) UpdateStatuses(ctx context.Context, orderIDs []int64,
 	if err != nil {
 		return err
 	}
-	cache.Cache.Order.Lock()
-	defer cache.Cache.Order.Unlock()
-	for _, orderId := range orderIDs {
-		if newStatus != "shipping" {
-			delete(cache.Cache.ShippingOrderProductId, orderId)
+	if err := insertStatusHistory(ctx, r.db, orderIDs, newStatus, sql.NullString{}, now); err != nil {
+		return err
+	}
+	if err := enqueueStatusWebhooks(ctx, r.db, statusWebhookEvents(orders, newStatus, sql.NullString{}, now)); err != nil {
+		return err
+	}
+	// キャンセルされた注文の在庫を戻す
+	var restored map[int]int
+	if newStatus == "cancelled" {
+		restored = make(map[int]int)
+		for _, order := range orders {
+			restored[order.ProductID] += order.Quantity
+		}
+		if err := restoreStock(ctx, r.db, restored); err != nil {
+			return err
 		}
+	}
+
+	r.cacheUpdates.add(func() {
+		applyStockLocked(restored)
+		for _, before := range orders {
+			order := before
+			order.ShippedStatus = newStatus
+			order.LeaseExpiresAt = sql.NullTime{}
+			switch newStatus {
+			case "shipping":
+				order.RobotID = sql.NullString{}
+			case "completed":
+				order.ArrivedAt = sql.NullTime{Time: now, Valid: true}
+			}
+			applyOrderLocked(before, order)
+		}
+		if newStatus == "shipping" {
+			cache.ShippingOrdersNotifier.Notify()
+		}
+	})
+	return nil
+}
+
+// 注文をロボットに割り当て、ステータスを配送中(delivering)に更新
+// leaseExpiresAt までに完了報告がなければ ReleaseExpiredLeases で shipping に戻される
+// 割り当てるのは現在も shipping の注文のみで、実際に割り当てた注文IDを返す
+// トランザクション内で呼び出すこと
+func (r *OrderRepository) AssignToRobot(ctx context.Context, robotID string, orderIDs []int64, leaseExpiresAt time.Time) ([]int64, error) {
+	orders, err := r.lockOrders(ctx, orderIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// 配送計画の計算中にキャンセル等で状態が変わった注文は除く
+	assignable := make([]model.Order, 0, len(orders))
+	assignableIDs := make([]int64, 0, len(orders))
+	for _, order := range orders {
+		if order.ShippedStatus == "shipping" {
+			assignable = append(assignable, order)
+			assignableIDs = append(assignableIDs, order.OrderID)
+		}
+	}
+	if len(assignable) == 0 {
+		return assignableIDs, nil
+	}
+
+	query, args, err := sqlx.In("UPDATE orders SET shipped_status = 'delivering', robot_id = ?, lease_expires_at = ? WHERE order_id IN (?)", robotID, leaseExpiresAt, assignableIDs)
+	if err != nil {
+		return nil, err
+	}
+	query = r.db.Rebind(query)
+	_, err = r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	robot := sql.NullString{String: robotID, Valid: true}
+	if err := insertStatusHistory(ctx, r.db, assignableIDs, "delivering", robot, now); err != nil {
+		return nil, err
+	}
+	if err := enqueueStatusWebhooks(ctx, r.db, statusWebhookEvents(assignable, "delivering", robot, now)); err != nil {
+		return nil, err
+	}
+
+	r.cacheUpdates.add(func() {
+		for _, before := range assignable {
+			order := before
+			order.ShippedStatus = "delivering"
+			order.RobotID = robot
+			order.LeaseExpiresAt = sql.NullTime{Time: leaseExpiresAt, Valid: true}
+			applyOrderLocked(before, order)
+		}
+	})
+	return assignableIDs, nil
+}
+
+// リース期限切れの配送中注文を shipping に戻し、戻した注文IDを返す
+// トランザクション内で呼び出すこと
+func (r *OrderRepository) ReleaseExpiredLeases(ctx context.Context, now time.Time) ([]int64, error) {
+	// 候補はキャッシュの索引から探し、期限切れかどうかは行ロックを取った DB の値で判定し直す
+	cache.Cache.Order.RLock()
+	candidates := make([]int64, 0)
+	for _, ids := range cache.Cache.RobotOrderIds {
+		for orderId := range ids {
+			e := cache.Cache.OrderIdUserId[orderId]
+			order := cache.Cache.UserOrders[e.UserID][e.Index]
+			if order.LeaseExpiresAt.Valid && !order.LeaseExpiresAt.Time.After(now) {
+				candidates = append(candidates, orderId)
+			}
+		}
+	}
+	cache.Cache.Order.RUnlock()
+	if len(candidates) == 0 {
+		return candidates, nil
+	}
+
+	orders, err := r.lockOrders(ctx, candidates)
+	if err != nil {
+		return nil, err
+	}
+	expired := make([]model.Order, 0, len(orders))
+	expiredIDs := make([]int64, 0, len(orders))
+	for _, order := range orders {
+		if order.ShippedStatus == "delivering" && order.LeaseExpiresAt.Valid && !order.LeaseExpiresAt.Time.After(now) {
+			expired = append(expired, order)
+			expiredIDs = append(expiredIDs, order.OrderID)
+		}
+	}
+	if err := r.updateStatuses(ctx, expired, "shipping"); err != nil {
+		return nil, err
+	}
+	return expiredIDs, nil
+}
+
+// 注文を取得。存在しなければ sql.ErrNoRows を返す
+func (r *OrderRepository) FindByID(ctx context.Context, orderID int64) (model.Order, error) {
+	cache.Cache.Order.RLock()
+	defer cache.Cache.Order.RUnlock()
+	e, ok := cache.Cache.OrderIdUserId[orderID]
+	if !ok {
+		return model.Order{}, sql.ErrNoRows
+	}
+	return cache.Cache.UserOrders[e.UserID][e.Index], nil
+}
+
+// ロボットが配送中(delivering)として保持している注文一覧を取得
+func (r *OrderRepository) GetRobotOrders(ctx context.Context, robotID string) ([]model.Order, error) {
+	cache.Cache.Order.RLock()
+	defer cache.Cache.Order.RUnlock()
+	ids := cache.Cache.RobotOrderIds[robotID]
+	orders := make([]model.Order, 0, len(ids))
+	for orderId := range ids {
 		e := cache.Cache.OrderIdUserId[orderId]
-		cache.Cache.UserOrders[e.UserID][e.Index].ShippedStatus = newStatus
+		order := cache.Cache.UserOrders[e.UserID][e.Index]
+		p := cache.Cache.ProductsById[order.ProductID]
+		order.ProductName = p.Name
+		fillLineTotals(&order, p)
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].OrderID < orders[j].OrderID })
+	return orders, nil
+}
+
+// 明細の重さ・容積・価値を商品の値の数量倍に設定する
+func fillLineTotals(order *model.Order, p model.Product) {
+	if order.Quantity <= 0 {
+		order.Quantity = 1
+	}
+	order.Weight = p.Weight * order.Quantity
+	order.Volume = p.Volume * order.Quantity
+	order.Value = p.Value * order.Quantity
+}
+
+// 配送待ちの明細を、先頭の quantity 個とそれ以外の2つに分割する
+// 元の注文IDは先頭の quantity 個を表すよう数量を減らし、残りは同じ親注文の新しい注文として shipping のまま作成する
+// splits は注文IDから残す数量への対応で、すでに shipping でない注文や数量が quantity 以下の注文は変更しない
+// トランザクション内で呼び出すこと
+func (r *OrderRepository) SplitOrders(ctx context.Context, splits map[int64]int) error {
+	if len(splits) == 0 {
+		return nil
 	}
+	orderIDs := make([]int64, 0, len(splits))
+	for orderId := range splits {
+		orderIDs = append(orderIDs, orderId)
+	}
+	orders, err := r.lockOrders(ctx, orderIDs)
+	if err != nil {
+		return err
+	}
+
+	type split struct{ before, order, rest model.Order }
+	done := make([]split, 0, len(orders))
+	for _, before := range orders {
+		quantity := splits[before.OrderID]
+		if quantity <= 0 || before.ShippedStatus != "shipping" || before.Quantity <= quantity {
+			continue
+		}
+
+		rest := before
+		rest.Quantity = before.Quantity - quantity
+		result, err := r.db.ExecContext(ctx,
+			"INSERT INTO orders (user_id, product_id, group_id, quantity, shipped_status, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			rest.UserID, rest.ProductID, rest.GroupID, rest.Quantity, rest.ShippedStatus, rest.CreatedAt)
+		if err != nil {
+			return err
+		}
+		rest.OrderID, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if _, err := r.db.ExecContext(ctx, "UPDATE orders SET quantity = ? WHERE order_id = ?", quantity, before.OrderID); err != nil {
+			return err
+		}
+		// 分割してできた注文も、元の注文と同じ時刻から配送待ちだったものとして記録する
+		if err := insertStatusHistory(ctx, r.db, []int64{rest.OrderID}, "shipping", sql.NullString{}, rest.CreatedAt); err != nil {
+			return err
+		}
+		event := newStatusWebhookEvent(rest, "", "shipping", sql.NullString{}, rest.CreatedAt)
+		if err := enqueueStatusWebhooks(ctx, r.db, []model.OrderStatusWebhookEvent{event}); err != nil {
+			return err
+		}
+
+		order := before
+		order.Quantity = quantity
+		done = append(done, split{before: before, order: order, rest: rest})
+	}
+
+	r.cacheUpdates.add(func() {
+		for _, s := range done {
+			applyOrderLocked(s.before, s.order)
+			cache.UpdateOrder(s.rest)
+		}
+	})
 	return nil
 }
 
@@ -104,16 +508,22 @@ func (r *OrderRepository) GetShippingOrders(ctx context.Context) ([]model.Order,
 
 	// err := r.db.SelectContext(ctx, &orders, query)
 
-	cache.Cache.Order.Lock()
-	defer cache.Cache.Order.Unlock()
+	cache.Cache.Order.RLock()
+	defer cache.Cache.Order.RUnlock()
 	var err error
 	orders := lo.MapToSlice(cache.Cache.ShippingOrderProductId, func(k int64, v int) model.Order {
 		p := cache.Cache.ProductsById[v]
-		return model.Order{
-			OrderID: k,
-			Weight:  p.Weight,
-			Value:   p.Value,
+		e := cache.Cache.OrderIdUserId[k]
+		current := cache.Cache.UserOrders[e.UserID][e.Index]
+		order := model.Order{
+			OrderID:   k,
+			ProductID: v,
+			GroupID:   current.GroupID,
+			Quantity:  current.Quantity,
+			CreatedAt: current.CreatedAt,
 		}
+		fillLineTotals(&order, p)
+		return order
 	})
 
 	return orders, err
@@ -121,8 +531,8 @@ func (r *OrderRepository) GetShippingOrders(ctx context.Context) ([]model.Order,
 
 // 配送対象となる(shipping)注文の件数を取得
 func (r *OrderRepository) CountShippingOrders(ctx context.Context) (int, error) {
-	cache.Cache.Order.Lock()
-	defer cache.Cache.Order.Unlock()
+	cache.Cache.Order.RLock()
+	defer cache.Cache.Order.RUnlock()
 	return len(cache.Cache.ShippingOrderProductId), nil
 }
 
@@ -236,33 +646,38 @@ func PageStable[T any](arr []T, less func(a, b T) bool, page, L int) []T {
 }
 
 // 注文履歴一覧を取得
+// req の絞り込み条件を満たす注文を並べ替え、req.Page ページ目 (カーソル指定時はその続き) を返す
 func (r *OrderRepository) ListOrders(ctx context.Context, userID int, req model.ListRequest) ([]model.Order, int, error) {
+	filter := newOrderFilter(req)
+
+	// 絞り込みはページングの前に行い、total は絞り込み後の件数とする
 	cache.Cache.Order.RLock()
 	ordersRaw := cache.Cache.UserOrders[userID]
-	cache.Cache.Order.RUnlock()
-
 	orders := make([]model.Order, 0, len(ordersRaw))
 	for _, o := range ordersRaw {
 		p := cache.Cache.ProductsById[o.ProductID]
-		productName := p.Name
-		if req.Search != "" {
-			if req.Type == "prefix" {
-				if !strings.HasPrefix(productName, req.Search) {
-					continue
-				}
-			} else {
-				if !strings.Contains(productName, req.Search) {
-					continue
-				}
-			}
+		if !filter.match(o, p.Name) {
+			continue
 		}
+		o.ProductName = p.Name
 		orders = append(orders, o)
+	}
+	cache.Cache.Order.RUnlock()
 
+	// カーソルが指定されていれば、カーソルの位置より後ろの注文を返す
+	var pivot *model.Order
+	if req.After != nil {
+		o, err := orderFromCursor(*req.After)
+		if err != nil {
+			return nil, 0, err
+		}
+		pivot = &o
 	}
 
 	var pagedOrders []model.Order
 	sortBy := func(less func(a, b model.Order) bool) {
-		pagedOrders = PageStable(orders, less, req.PageSize, req.Offset)
+		less = thenByID(less, func(o model.Order) int64 { return o.OrderID })
+		pagedOrders = pageAfter(orders, less, pivot, req.Page, req.PageSize)
 	}
 
 	switch req.SortField {
@@ -326,16 +741,105 @@ func (r *OrderRepository) ListOrders(ctx context.Context, userID int, req model.
 		}
 	}
 
-	total := len(orders)
-	start := req.Offset
-	end := req.Offset + req.PageSize
+	if pagedOrders == nil {
+		pagedOrders = []model.Order{}
+	}
+	return pagedOrders, len(orders), nil
+}
+
+// 注文履歴のエクスポートで一度に読み出す件数
+const orderExportChunkSize = 500
+
+// 絞り込み条件を満たす注文を作成順に読み出し、orderExportChunkSize 件ずつ fn に渡す
+// 書き出しの間に注文の更新を止めないよう、キャッシュのロックは読み出しの間だけ取る
+// UserOrders は追記のみのため、ロックを取り直しても読み出し位置はずれない
+func (r *OrderRepository) ExportOrders(ctx context.Context, userID int, req model.ListRequest, fn func([]model.Order) error) error {
+	filter := newOrderFilter(req)
+	chunk := make([]model.Order, 0, orderExportChunkSize)
+	for i := 0; ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk = chunk[:0]
+		cache.Cache.Order.RLock()
+		ordersRaw := cache.Cache.UserOrders[userID]
+		for ; i < len(ordersRaw) && len(chunk) < orderExportChunkSize; i++ {
+			o := ordersRaw[i]
+			p := cache.Cache.ProductsById[o.ProductID]
+			if !filter.match(o, p.Name) {
+				continue
+			}
+			o.ProductName = p.Name
+			chunk = append(chunk, o)
+		}
+		done := i >= len(ordersRaw)
+		cache.Cache.Order.RUnlock()
+
+		if len(chunk) > 0 {
+			if err := fn(chunk); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// 注文履歴を親注文ごとにまとめて取得
+// 絞り込み条件は明細に対して適用し、条件に合う明細を含む親注文を新しい順 (sort_order が asc なら古い順) に返す
+func (r *OrderRepository) ListOrderGroups(ctx context.Context, userID int, req model.ListRequest) ([]model.OrderGroup, int, error) {
+	filter := newOrderFilter(req)
+
+	cache.Cache.Order.RLock()
+	ordersRaw := make([]model.Order, len(cache.Cache.UserOrders[userID]))
+	copy(ordersRaw, cache.Cache.UserOrders[userID])
+	cache.Cache.Order.RUnlock()
+
+	groups := make([]model.OrderGroup, 0)
+	index := make(map[int64]int)
+	for _, o := range ordersRaw {
+		p := cache.Cache.ProductsById[o.ProductID]
+		if !filter.match(o, p.Name) {
+			continue
+		}
+		o.ProductName = p.Name
+
+		// 親注文を持たない注文は単独の親注文として扱う
+		key := o.GroupID
+		if key == 0 {
+			key = -o.OrderID
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, model.OrderGroup{GroupID: o.GroupID, UserID: o.UserID, CreatedAt: o.CreatedAt})
+		}
+		groups[i].Items = append(groups[i].Items, model.OrderGroupItem{Order: o, GroupID: o.GroupID, Quantity: o.Quantity})
+	}
+
+	desc := strings.ToUpper(req.SortOrder) != "ASC"
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.After(b.CreatedAt) == desc
+		}
+		return (a.Items[0].OrderID > b.Items[0].OrderID) == desc
+	})
+	for _, g := range groups {
+		sort.Slice(g.Items, func(i, j int) bool { return g.Items[i].OrderID < g.Items[j].OrderID })
+	}
+
+	total := len(groups)
+	start := (req.Page - 1) * req.PageSize
+	end := start + req.PageSize
 	if start > total {
 		start = total
 	}
 	if end > total {
 		end = total
 	}
-	pagedOrders = orders[start:end]
-
-	return pagedOrders, total, nil
+	return groups[start:end], total, nil
 }
@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"backend/internal/model"
+	"strings"
+	"time"
+)
+
+// 注文履歴の絞り込み条件
+type orderFilter struct {
+	search      string
+	prefix      bool
+	statuses    map[string]struct{}
+	productIDs  map[int]struct{}
+	createdFrom *time.Time
+	createdTo   *time.Time
+	arrivedFrom *time.Time
+	arrivedTo   *time.Time
+}
+
+func newOrderFilter(req model.ListRequest) orderFilter {
+	f := orderFilter{
+		search:      req.Search,
+		prefix:      req.Type == "prefix",
+		createdFrom: req.CreatedFrom,
+		createdTo:   req.CreatedTo,
+		arrivedFrom: req.ArrivedFrom,
+		arrivedTo:   req.ArrivedTo,
+	}
+	if len(req.ShippedStatuses) > 0 {
+		f.statuses = make(map[string]struct{}, len(req.ShippedStatuses))
+		for _, s := range req.ShippedStatuses {
+			f.statuses[s] = struct{}{}
+		}
+	}
+	if len(req.ProductIDs) > 0 {
+		f.productIDs = make(map[int]struct{}, len(req.ProductIDs))
+		for _, id := range req.ProductIDs {
+			f.productIDs[id] = struct{}{}
+		}
+	}
+	return f
+}
+
+// 注文が絞り込み条件をすべて満たすか
+func (f orderFilter) match(o model.Order, productName string) bool {
+	if f.search != "" {
+		if f.prefix {
+			if !strings.HasPrefix(productName, f.search) {
+				return false
+			}
+		} else if !strings.Contains(productName, f.search) {
+			return false
+		}
+	}
+	if f.statuses != nil {
+		if _, ok := f.statuses[o.ShippedStatus]; !ok {
+			return false
+		}
+	}
+	if f.productIDs != nil {
+		if _, ok := f.productIDs[o.ProductID]; !ok {
+			return false
+		}
+	}
+	if !inRange(o.CreatedAt, f.createdFrom, f.createdTo) {
+		return false
+	}
+	if f.arrivedFrom != nil || f.arrivedTo != nil {
+		if !o.ArrivedAt.Valid || !inRange(o.ArrivedAt.Time, f.arrivedFrom, f.arrivedTo) {
+			return false
+		}
+	}
+	return true
+}
+
+// t が from 以上 to 未満か。nil の端は制限なし
+func inRange(t time.Time, from, to *time.Time) bool {
+	if from != nil && t.Before(*from) {
+		return false
+	}
+	if to != nil && !t.Before(*to) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+package repository
+
+import (
+	"backend/internal/model"
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// 注文ステータスの変更履歴を記録する
+// 注文ステータスを変更する OrderRepository の各処理から、同じ DB 接続 (トランザクション) で呼び出す
+func insertStatusHistory(ctx context.Context, db DBTX, orderIDs []int64, status string, robotID sql.NullString, changedAt time.Time) error {
+	if len(orderIDs) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(orderIDs))
+	args := make([]interface{}, 0, len(orderIDs)*4)
+	for i, orderId := range orderIDs {
+		placeholders[i] = "(?, ?, ?, ?)"
+		args = append(args, orderId, status, robotID, changedAt)
+	}
+	query := "INSERT INTO order_status_history (order_id, status, robot_id, changed_at) VALUES " + strings.Join(placeholders, ", ")
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// 注文ステータスの変更履歴を古い順に取得
+func (r *OrderRepository) GetStatusHistory(ctx context.Context, orderID int64) ([]model.OrderStatusEvent, error) {
+	events := make([]model.OrderStatusEvent, 0)
+	query := `SELECT order_id, status, robot_id, changed_at FROM order_status_history WHERE order_id = ? ORDER BY history_id`
+	if err := r.db.SelectContext(ctx, &events, query, orderID); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
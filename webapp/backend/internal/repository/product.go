@@ -4,6 +4,7 @@ import (
 	cache "backend/internal"
 	"backend/internal/model"
 	"context"
+	"database/sql"
 	"fmt"
 	"runtime"
 	"strings"
@@ -19,29 +20,91 @@ func NewProductRepository(db DBTX) *ProductRepository {
 }
 
 // 商品一覧を全件取得し、アプリケーション側でページング処理を行う
+// 在庫数と在庫の有無を含み、InStockOnly の場合は在庫のある商品のみを返す
+// カーソルが指定された場合は、ソート列と商品IDがカーソルの位置より後ろの商品を返す
 func (r *ProductRepository) ListProducts(ctx context.Context, userID int, req model.ListRequest) ([]model.Product, int, error) {
 	var products []model.Product
 
 	if req.Search == "" {
+		var conds []string
+		var args []interface{}
+		if req.InStockOnly {
+			conds = append(conds, "stock > 0")
+		}
+		where := ""
+		if len(conds) > 0 {
+			where = " WHERE " + strings.Join(conds, " AND ")
+		}
+
+		column := productSortColumn(req.SortField)
+		order := strings.ToUpper(normalizeSortOrder(req.SortOrder))
+		cmp := ">"
+		if order == "DESC" {
+			cmp = "<"
+		}
+		page := " LIMIT " + fmt.Sprintf("%d", req.PageSize) + " OFFSET " + fmt.Sprintf("%d", req.Offset)
+		if req.After != nil {
+			if column == "product_id" {
+				conds = append(conds, "product_id "+cmp+" ?")
+				args = append(args, req.After.ID)
+			} else {
+				conds = append(conds, "("+column+" "+cmp+" ? OR ("+column+" = ? AND product_id > ?))")
+				args = append(args, req.After.Key, req.After.Key, req.After.ID)
+			}
+			page = " LIMIT " + fmt.Sprintf("%d", req.PageSize)
+		}
+		pageWhere := ""
+		if len(conds) > 0 {
+			pageWhere = " WHERE " + strings.Join(conds, " AND ")
+		}
 		baseQuery := `
-		SELECT product_id, name, value, weight, image, description
+		SELECT product_id, name, value, weight, volume, image, description
 		FROM products
-	` + " ORDER BY " + req.SortField + " " + req.SortOrder + " , product_id ASC LIMIT " + fmt.Sprintf("%d", req.PageSize) + " OFFSET " + fmt.Sprintf("%d", req.Offset)
+	` + pageWhere + " ORDER BY " + column + " " + order + " , product_id ASC" + page
 
-		err := r.db.SelectContext(ctx, &products, baseQuery)
+		err := r.db.SelectContext(ctx, &products, baseQuery, args...)
 		if err != nil {
 			return nil, 0, err
 		}
-		return products, cache.Cache.ProductsCnt, nil
+		fillStock(products)
+
+		total := cache.Cache.ProductsCnt
+		if req.InStockOnly {
+			if err := r.db.GetContext(ctx, &total, "SELECT COUNT(*) FROM products"+where); err != nil {
+				return nil, 0, err
+			}
+		}
+		return products, total, nil
 	} else {
 		products = SearchProducts(cache.Cache.ProductsById, req.Search)
+		fillStock(products)
+		if req.InStockOnly {
+			inStock := products[:0]
+			for _, p := range products {
+				if p.InStock {
+					inStock = append(inStock, p)
+				}
+			}
+			products = inStock
+		}
+
+		var pivot *model.Product
+		if req.After != nil {
+			p, err := productFromCursor(*req.After)
+			if err != nil {
+				return nil, 0, err
+			}
+			pivot = &p
+		}
 
+		// 検索結果は並列に集めるため順序が一定でない。同じソートキーの商品は商品IDの昇順に並べる
 		var paged []model.Product
 		sortBy := func(less func(a, b model.Product) bool) {
-			paged = PageStable(products, less, req.PageSize, req.Offset)
+			less = thenByID(less, func(p model.Product) int64 { return int64(p.ProductID) })
+			paged = pageAfter(products, less, pivot, req.Page, req.PageSize)
 		}
 
-		switch req.SortField {
+		switch productSortColumn(req.SortField) {
 		case "name":
 			if strings.ToUpper(req.SortOrder) == "DESC" {
 				sortBy(func(i, j model.Product) bool {
@@ -93,6 +156,16 @@ func (r *ProductRepository) ListProducts(ctx context.Context, userID int, req mo
 				})
 			}
 
+		case "volume":
+			if strings.ToUpper(req.SortOrder) == "DESC" {
+				sortBy(func(i, j model.Product) bool {
+					return i.Volume > j.Volume
+				})
+			} else {
+				sortBy(func(i, j model.Product) bool {
+					return i.Volume < j.Volume
+				})
+			}
 		case "product_id":
 			fallthrough
 		default:
@@ -107,18 +180,10 @@ func (r *ProductRepository) ListProducts(ctx context.Context, userID int, req mo
 			}
 		}
 
-		total := len(products)
-		start := req.Offset
-		end := req.Offset + req.PageSize
-		if start > total {
-			start = total
-		}
-		if end > total {
-			end = total
+		if paged == nil {
+			paged = []model.Product{}
 		}
-		paged = products[start:end]
-
-		return paged, total, nil
+		return paged, len(products), nil
 	}
 }
 func SearchProducts(productsById []model.Product, query string) []model.Product {
@@ -159,3 +224,18 @@ func SearchProducts(productsById []model.Product, query string) []model.Product
 	}
 	return results
 }
+
+// 商品を取得。存在しなければ sql.ErrNoRows を返す
+func (r *ProductRepository) FindByID(ctx context.Context, productID int) (model.Product, error) {
+	if productID <= 0 || productID >= len(cache.Cache.ProductsById) {
+		return model.Product{}, sql.ErrNoRows
+	}
+	// 商品IDが欠番の場合はゼロ値が入っている
+	p := cache.Cache.ProductsById[productID]
+	if p.ProductID != productID {
+		return model.Product{}, sql.ErrNoRows
+	}
+	products := []model.Product{p}
+	fillStock(products)
+	return products[0], nil
+}
@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"backend/internal/model"
+	"context"
+	"time"
+)
+
+type RobotCredentialRepository struct {
+	db DBTX
+}
+
+func NewRobotCredentialRepository(db DBTX) *RobotCredentialRepository {
+	return &RobotCredentialRepository{db: db}
+}
+
+func (r *RobotCredentialRepository) Create(ctx context.Context, cred *model.RobotCredential) error {
+	query := `INSERT INTO robot_credentials (key_id, robot_id, key_hash, created_at) VALUES (:key_id, :robot_id, :key_hash, :created_at)`
+	_, err := r.db.NamedExecContext(ctx, query, cred)
+	return err
+}
+
+// 失効していない全ロボットのキーを取得
+func (r *RobotCredentialRepository) ListValid(ctx context.Context, now time.Time) ([]model.RobotCredential, error) {
+	creds := make([]model.RobotCredential, 0)
+	query := `SELECT * FROM robot_credentials WHERE revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)`
+	if err := r.db.SelectContext(ctx, &creds, query, now); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// ロボットのキーを失効済みのものも含めて取得
+func (r *RobotCredentialRepository) ListByRobot(ctx context.Context, robotID string) ([]model.RobotCredential, error) {
+	creds := make([]model.RobotCredential, 0)
+	query := `SELECT * FROM robot_credentials WHERE robot_id = ? ORDER BY created_at DESC`
+	if err := r.db.SelectContext(ctx, &creds, query, robotID); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// ロボットの有効なキーの失効日時を expiresAt に設定する
+// すでにそれより早く失効する予定のキーは変更しない
+func (r *RobotCredentialRepository) ExpireValid(ctx context.Context, robotID string, expiresAt time.Time) error {
+	query := `
+		UPDATE robot_credentials SET expires_at = ?
+		WHERE robot_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)`
+	_, err := r.db.ExecContext(ctx, query, expiresAt, robotID, expiresAt)
+	return err
+}
+
+// キーを即時に失効させる。対象のキーが存在しなければ false を返す
+func (r *RobotCredentialRepository) Revoke(ctx context.Context, robotID, keyID string, revokedAt time.Time) (bool, error) {
+	query := `UPDATE robot_credentials SET revoked_at = ? WHERE robot_id = ? AND key_id = ? AND revoked_at IS NULL`
+	result, err := r.db.ExecContext(ctx, query, revokedAt, robotID, keyID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	cache "backend/internal"
+	"backend/internal/model"
+	"context"
+	"fmt"
+	"sort"
+)
+
+// 在庫が足りなかった商品
+type StockShortage struct {
+	ProductID int
+	Requested int
+	Available int
+}
+
+// 注文に対して在庫が足りない場合のエラー
+type OutOfStockError struct {
+	Shortages []StockShortage
+}
+
+func (e *OutOfStockError) Error() string {
+	return fmt.Sprintf("out of stock: %d product(s)", len(e.Shortages))
+}
+
+func sortedProductIDs(quantities map[int]int) []int {
+	ids := make([]int, 0, len(quantities))
+	for id := range quantities {
+		ids = append(ids, id)
+	}
+	// 複数の注文が同時に在庫を更新してもデッドロックしないよう、常に商品ID順に更新する
+	sort.Ints(ids)
+	return ids
+}
+
+// 商品ごとに quantities の数だけ在庫を減らす
+// 1つでも在庫が足りなければ *OutOfStockError を返す。減らした分は呼び出し元のトランザクションのロールバックで戻す
+// DB のみを更新するため、確定後に applyStockLocked でキャッシュに反映すること
+func decrementStock(ctx context.Context, db DBTX, quantities map[int]int) error {
+	var shortages []StockShortage
+	for _, productID := range sortedProductIDs(quantities) {
+		q := quantities[productID]
+		result, err := db.ExecContext(ctx, "UPDATE products SET stock = stock - ? WHERE product_id = ? AND stock >= ?", q, productID, q)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			var available int
+			if err := db.GetContext(ctx, &available, "SELECT stock FROM products WHERE product_id = ?", productID); err != nil {
+				return err
+			}
+			shortages = append(shortages, StockShortage{ProductID: productID, Requested: q, Available: available})
+		}
+	}
+	if len(shortages) > 0 {
+		return &OutOfStockError{Shortages: shortages}
+	}
+	return nil
+}
+
+// 商品ごとに quantities の数だけ在庫を戻す
+// DB のみを更新するため、確定後に applyStockLocked でキャッシュに反映すること
+func restoreStock(ctx context.Context, db DBTX, quantities map[int]int) error {
+	for _, productID := range sortedProductIDs(quantities) {
+		if _, err := db.ExecContext(ctx, "UPDATE products SET stock = stock + ? WHERE product_id = ?", quantities[productID], productID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 在庫の増減をキャッシュに反映する
+// 呼び出し元で cache.Cache.Order のロックを取得していること
+func applyStockLocked(delta map[int]int) {
+	for productID, d := range delta {
+		cache.Cache.ProductStock[productID] += d
+	}
+}
+
+// 商品に現在の在庫数を設定する
+func fillStock(products []model.Product) {
+	cache.Cache.Order.RLock()
+	defer cache.Cache.Order.RUnlock()
+	for i := range products {
+		products[i].Stock = cache.Cache.ProductStock[products[i].ProductID]
+		products[i].InStock = products[i].Stock > 0
+	}
+}
@@ -7,20 +7,35 @@ import (
 )
 
 type Store struct {
-	db          DBTX
-	UserRepo    *UserRepository
-	SessionRepo *SessionRepository
-	ProductRepo *ProductRepository
-	OrderRepo   *OrderRepository
+	db               DBTX
+	cacheUpdates     *cacheUpdates
+	UserRepo         *UserRepository
+	SessionRepo      *SessionRepository
+	ProductRepo      *ProductRepository
+	OrderRepo        *OrderRepository
+	DeliveryPlanRepo *DeliveryPlanRepository
+	RobotCredRepo    *RobotCredentialRepository
+	WebhookRepo      *WebhookRepository
 }
 
 func NewStore(db DBTX) *Store {
+	return newStore(db, &cacheUpdates{})
+}
+
+// updates はこの Store の各リポジトリが共有するキャッシュへの反映
+func newStore(db DBTX, updates *cacheUpdates) *Store {
+	orderRepo := NewOrderRepository(db)
+	orderRepo.cacheUpdates = updates
 	return &Store{
-		db:          db,
-		UserRepo:    NewUserRepository(db),
-		SessionRepo: NewSessionRepository(db),
-		ProductRepo: NewProductRepository(db),
-		OrderRepo:   NewOrderRepository(db),
+		db:               db,
+		cacheUpdates:     updates,
+		UserRepo:         NewUserRepository(db),
+		SessionRepo:      NewSessionRepository(db),
+		ProductRepo:      NewProductRepository(db),
+		OrderRepo:        orderRepo,
+		DeliveryPlanRepo: NewDeliveryPlanRepository(db),
+		RobotCredRepo:    NewRobotCredentialRepository(db),
+		WebhookRepo:      NewWebhookRepository(db),
 	}
 }
 
@@ -36,10 +51,11 @@ func (s *Store) ExecTx(ctx context.Context, fn func(txStore *Store) error) error
 	}
 	defer tx.Rollback()
 
-	txStore := NewStore(tx)
+	// キャッシュへの反映はコミット後に行う
+	txStore := newStore(tx, &cacheUpdates{deferred: true})
 	if err := fn(txStore); err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	return txStore.cacheUpdates.commit(tx)
 }
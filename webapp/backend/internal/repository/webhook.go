@@ -0,0 +1,229 @@
+package repository
+
+import (
+	"backend/internal/model"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// Webhook の送信状態
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryDead      = "dead"
+)
+
+// 1つの INSERT 文で登録する送信待ちの最大件数 (プレースホルダ数の上限対策)
+const webhookOutboxInsertChunk = 1000
+
+const webhookDeliveryColumns = `
+	o.delivery_id, o.webhook_id, w.url, w.secret, w.active, o.event_id, o.payload, o.status,
+	o.attempts, o.next_attempt_at, o.last_status_code, o.last_error, o.created_at, o.delivered_at`
+
+type WebhookRepository struct {
+	db DBTX
+}
+
+func NewWebhookRepository(db DBTX) *WebhookRepository {
+	return &WebhookRepository{db: db}
+}
+
+// Webhook の送信先を登録し、採番したIDを設定する
+func (r *WebhookRepository) Create(ctx context.Context, webhook *model.Webhook) error {
+	result, err := r.db.ExecContext(ctx,
+		"INSERT INTO webhooks (url, secret, active, created_at) VALUES (?, ?, TRUE, ?)",
+		webhook.URL, webhook.Secret, webhook.CreatedAt)
+	if err != nil {
+		return err
+	}
+	webhook.WebhookID, err = result.LastInsertId()
+	webhook.Active = true
+	return err
+}
+
+// Webhook の送信先を無効化したものも含めて取得
+func (r *WebhookRepository) List(ctx context.Context) ([]model.Webhook, error) {
+	webhooks := make([]model.Webhook, 0)
+	err := r.db.SelectContext(ctx, &webhooks, "SELECT webhook_id, url, secret, active, created_at FROM webhooks ORDER BY webhook_id")
+	return webhooks, err
+}
+
+// Webhook の送信先を無効化する。有効な送信先が見つからなければ false を返す
+func (r *WebhookRepository) Deactivate(ctx context.Context, webhookID int64) (bool, error) {
+	result, err := r.db.ExecContext(ctx, "UPDATE webhooks SET active = FALSE WHERE webhook_id = ? AND active", webhookID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// 注文ステータスの変更イベントを作る
+// previous は変更前のステータスで、注文の作成時は空
+func newStatusWebhookEvent(order model.Order, previous, status string, robotID sql.NullString, at time.Time) model.OrderStatusWebhookEvent {
+	return model.OrderStatusWebhookEvent{
+		EventID:    uuid.NewString(),
+		Type:       "order.status_changed",
+		OccurredAt: at,
+		Data: model.OrderStatusWebhookData{
+			OrderID:        order.OrderID,
+			UserID:         order.UserID,
+			GroupID:        order.GroupID,
+			ProductID:      order.ProductID,
+			Quantity:       order.Quantity,
+			Status:         status,
+			PreviousStatus: previous,
+			RobotID:        robotID.String,
+		},
+	}
+}
+
+// 変更前の注文からステータス変更イベントを作る
+// robotID が指定されていなければ注文を担当しているロボットとする
+func statusWebhookEvents(orders []model.Order, status string, robotID sql.NullString, at time.Time) []model.OrderStatusWebhookEvent {
+	events := make([]model.OrderStatusWebhookEvent, 0, len(orders))
+	for _, order := range orders {
+		rid := robotID
+		if !rid.Valid {
+			rid = order.RobotID
+		}
+		events = append(events, newStatusWebhookEvent(order, order.ShippedStatus, status, rid, at))
+	}
+	return events
+}
+
+// 注文ステータスの変更イベントを、有効な Webhook の送信先ごとに送信待ちとして登録する
+// 注文ステータスを変更する OrderRepository の各処理から、同じ DB 接続 (トランザクション) で呼び出す
+func enqueueStatusWebhooks(ctx context.Context, db DBTX, events []model.OrderStatusWebhookEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var webhookIDs []int64
+	if err := db.SelectContext(ctx, &webhookIDs, "SELECT webhook_id FROM webhooks WHERE active"); err != nil {
+		return err
+	}
+	if len(webhookIDs) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	placeholders := make([]string, 0, webhookOutboxInsertChunk)
+	args := make([]interface{}, 0, webhookOutboxInsertChunk*4)
+	flush := func() error {
+		if len(placeholders) == 0 {
+			return nil
+		}
+		query := "INSERT INTO webhook_outbox (webhook_id, event_id, payload, status, next_attempt_at, created_at) VALUES " + strings.Join(placeholders, ", ")
+		_, err := db.ExecContext(ctx, query, args...)
+		placeholders = placeholders[:0]
+		args = args[:0]
+		return err
+	}
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		for _, webhookID := range webhookIDs {
+			placeholders = append(placeholders, "(?, ?, ?, '"+WebhookDeliveryPending+"', ?, ?)")
+			// JSON 型の列にはバイナリではなく文字列として渡す
+			args = append(args, webhookID, event.EventID, string(payload), now, now)
+			if len(placeholders) == webhookOutboxInsertChunk {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return flush()
+}
+
+// 送信時刻を過ぎた送信待ちを最大 limit 件取得し、claimFor の間は他の送信処理から取得されないようにする
+// 送信処理が途中で止まっても、claimFor を過ぎれば再び取得される。トランザクション内で呼び出すこと
+func (r *WebhookRepository) ClaimDue(ctx context.Context, now time.Time, limit int, claimFor time.Duration) ([]model.WebhookDelivery, error) {
+	deliveries := make([]model.WebhookDelivery, 0)
+	query := `SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_outbox o
+		JOIN webhooks w ON w.webhook_id = o.webhook_id
+		WHERE o.status = ? AND o.next_attempt_at <= ?
+		ORDER BY o.next_attempt_at, o.delivery_id
+		LIMIT ?
+		FOR UPDATE OF o SKIP LOCKED`
+	if err := r.db.SelectContext(ctx, &deliveries, query, WebhookDeliveryPending, now, limit); err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return deliveries, nil
+	}
+
+	ids := make([]int64, len(deliveries))
+	for i, d := range deliveries {
+		ids[i] = d.DeliveryID
+	}
+	q, args, err := sqlx.In("UPDATE webhook_outbox SET next_attempt_at = ? WHERE delivery_id IN (?)", now.Add(claimFor), ids)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.db.ExecContext(ctx, r.db.Rebind(q), args...); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// 送信に成功したことを記録する
+func (r *WebhookRepository) MarkDelivered(ctx context.Context, deliveryID int64, attempts, statusCode int, deliveredAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE webhook_outbox
+		SET status = ?, attempts = ?, last_status_code = ?, last_error = NULL, delivered_at = ?
+		WHERE delivery_id = ?`,
+		WebhookDeliveryDelivered, attempts, statusCode, deliveredAt, deliveryID)
+	return err
+}
+
+// 送信に失敗したことを記録する
+// dead の場合は再送せず、そうでなければ nextAttemptAt に再送する
+func (r *WebhookRepository) MarkFailed(ctx context.Context, deliveryID int64, attempts int, statusCode *int, lastError string, nextAttemptAt time.Time, dead bool) error {
+	status := WebhookDeliveryPending
+	if dead {
+		status = WebhookDeliveryDead
+	}
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE webhook_outbox
+		SET status = ?, attempts = ?, last_status_code = ?, last_error = ?, next_attempt_at = ?
+		WHERE delivery_id = ?`,
+		status, attempts, statusCode, lastError, nextAttemptAt, deliveryID)
+	return err
+}
+
+// 指定した状態の送信を新しい順に最大 limit 件取得
+func (r *WebhookRepository) ListDeliveries(ctx context.Context, status string, limit int) ([]model.WebhookDelivery, error) {
+	deliveries := make([]model.WebhookDelivery, 0)
+	query := `SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_outbox o
+		JOIN webhooks w ON w.webhook_id = o.webhook_id
+		WHERE o.status = ?
+		ORDER BY o.delivery_id DESC
+		LIMIT ?`
+	err := r.db.SelectContext(ctx, &deliveries, query, status, limit)
+	return deliveries, err
+}
+
+// 再送上限に達した送信を、試行回数を戻して送信待ちに戻す
+// 対象の送信が見つからない、または dead でなければ false を返す
+func (r *WebhookRepository) Replay(ctx context.Context, deliveryID int64, now time.Time) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE webhook_outbox SET status = ?, attempts = 0, next_attempt_at = ?
+		WHERE delivery_id = ? AND status = ?`,
+		WebhookDeliveryPending, now, deliveryID, WebhookDeliveryDead)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -6,14 +6,20 @@ import (
 	"backend/internal/middleware"
 	"backend/internal/repository"
 	"backend/internal/service"
+	"backend/internal/utils"
+	"context"
+	"crypto/rand"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	chiMiddleware "github.com/go-chi/chi/v5/middleware"
 	"github.com/jmoiron/sqlx"
 	"github.com/kaz/pprotein/integration"
+	"github.com/redis/go-redis/v9"
 	"github.com/riandyrn/otelchi"
 )
 
@@ -32,21 +38,94 @@ func NewServer() (*Server, *sqlx.DB, error) {
 	authService := service.NewAuthService(store)
 	orderService := service.NewOrderService(store)
 	productService := service.NewProductService(store)
-	robotService := service.NewRobotService(store)
+	robotService := service.NewRobotService(store, service.RobotConfig{
+		LeaseDuration:      envDuration("ROBOT_LEASE_DURATION", 5*time.Minute),
+		LeaseReapInterval:  envDuration("ROBOT_LEASE_REAP_INTERVAL", 5*time.Second),
+		PlanMaxWait:        envDuration("DELIVERY_PLAN_MAX_WAIT", 30*time.Second),
+		DefaultOptimizer:   envString("DELIVERY_OPTIMIZER", "dp"),
+		DefaultGranularity: envString("DELIVERY_PLAN_GRANULARITY", service.GranularityUnit),
+		Priority: service.PriorityConfig{
+			AgingRatePerHour: envFloat("DELIVERY_AGING_RATE_PER_HOUR", 0),
+			Deadline:         envDuration("DELIVERY_DEADLINE", 0),
+		},
+	})
+	deliveryPlanService := service.NewDeliveryPlanService(store)
+	robotSigningSecret, err := newRobotSigningSecret()
+	if err != nil {
+		return nil, nil, err
+	}
+	robotCredService := service.NewRobotCredentialService(store, robotSigningSecret)
+	webhookService := service.NewWebhookService(store, service.WebhookConfig{
+		MaxAttempts:    envInt("WEBHOOK_MAX_ATTEMPTS", 10),
+		RetryBaseDelay: envDuration("WEBHOOK_RETRY_BASE_DELAY", 10*time.Second),
+		RetryMaxDelay:  envDuration("WEBHOOK_RETRY_MAX_DELAY", time.Hour),
+		PollInterval:   envDuration("WEBHOOK_POLL_INTERVAL", time.Second),
+		BatchSize:      envInt("WEBHOOK_BATCH_SIZE", 50),
+		Timeout:        envDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+	})
+
+	go robotService.RunLeaseReaper(context.Background())
+	go webhookService.RunDispatcher(context.Background())
+	go robotCredService.RunReloader(context.Background(), envDuration("ROBOT_CREDENTIAL_RELOAD_INTERVAL", 10*time.Second))
+
+	cursorSigner, err := newCursorSigner()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	authHandler := handler.NewAuthHandler(authService)
-	productHandler := handler.NewProductHandler(productService)
-	orderHandler := handler.NewOrderHandler(orderService)
+	productHandler := handler.NewProductHandler(productService, cursorSigner)
+	orderHandler := handler.NewOrderHandler(orderService, cursorSigner)
 	robotHandler := handler.NewRobotHandler(robotService)
+	deliveryPlanHandler := handler.NewDeliveryPlanHandler(deliveryPlanService)
+	robotCredHandler := handler.NewRobotCredentialHandler(robotCredService)
+	webhookHandler := handler.NewWebhookHandler(webhookService)
 
 	userAuthMW := middleware.UserAuthMiddleware(store.SessionRepo)
 
-	robotAPIKey := os.Getenv("ROBOT_API_KEY")
-	if robotAPIKey == "" {
-		log.Println("Warning: ROBOT_API_KEY is not set. Using default key 'test-robot-key'")
-		robotAPIKey = "test-robot-key"
+	// 全ロボット共通のAPIキー。ロボットごとのキーへ移行した後は ROBOT_LEGACY_API_KEY_ENABLED=false で無効にする
+	robotAPIKey := ""
+	if envBool("ROBOT_LEGACY_API_KEY_ENABLED", true) {
+		robotAPIKey = os.Getenv("ROBOT_API_KEY")
+		if robotAPIKey == "" {
+			log.Println("Warning: ROBOT_API_KEY is not set. Using default key 'test-robot-key'")
+			robotAPIKey = "test-robot-key"
+		}
+	} else {
+		log.Println("Legacy ROBOT_API_KEY is disabled. Robots must use per-robot keys")
 	}
-	robotAuthMW := middleware.RobotAuthMiddleware(robotAPIKey)
+	robotAuthMode := envString("ROBOT_AUTH_MODE", middleware.RobotAuthModeKey)
+	switch robotAuthMode {
+	case middleware.RobotAuthModeKey, middleware.RobotAuthModeHMAC, middleware.RobotAuthModeBoth:
+	default:
+		log.Printf("Warning: invalid ROBOT_AUTH_MODE=%q. Using default %q", robotAuthMode, middleware.RobotAuthModeKey)
+		robotAuthMode = middleware.RobotAuthModeKey
+	}
+	nonceStore, err := utils.NewInMemoryLRUCache[string, int64](envInt("ROBOT_AUTH_NONCE_CACHE_SIZE", 100000))
+	if err != nil {
+		return nil, nil, err
+	}
+	robotAuthMW := middleware.RobotAuthMiddleware(middleware.RobotAuthConfig{
+		Mode:         robotAuthMode,
+		LegacyAPIKey: robotAPIKey,
+		MaxClockSkew: envDuration("ROBOT_AUTH_MAX_CLOCK_SKEW", 5*time.Minute),
+		Nonces:       nonceStore,
+	}, robotCredService)
+
+	// 管理用APIは既定のキーでは公開せず、ADMIN_API_KEY が設定されている場合のみ有効にする
+	var adminAuthMW func(http.Handler) http.Handler
+	if adminAPIKey := os.Getenv("ADMIN_API_KEY"); adminAPIKey != "" {
+		adminAuthMW = middleware.AdminAuthMiddleware(adminAPIKey)
+	} else {
+		log.Println("Warning: ADMIN_API_KEY is not set. /api/admin is disabled")
+	}
+
+	idempotencyTTL := envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+	idempotencyStore, idempotencyLocker, err := newIdempotencyStore(idempotencyTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+	idempotencyMW := middleware.IdempotencyMiddleware(idempotencyStore, idempotencyLocker, idempotencyTTL)
 
 	r := chi.NewRouter()
 	r.Use(otelchi.Middleware(
@@ -69,11 +148,117 @@ func NewServer() (*Server, *sqlx.DB, error) {
 		Router: r,
 	}
 
-	s.setupRoutes(authHandler, productHandler, orderHandler, robotHandler, userAuthMW, robotAuthMW)
+	s.setupRoutes(authHandler, productHandler, orderHandler, robotHandler, deliveryPlanHandler, robotCredHandler, webhookHandler, userAuthMW, robotAuthMW, adminAuthMW, idempotencyMW)
 
 	return s, dbConn, nil
 }
 
+// 冪等キーの保存先と、処理中のキーのロックを作成する
+// IDEMPOTENCY_REDIS_ADDR が設定されていれば Redis、なければプロセス内の LRU キャッシュを使う
+// Redis では ttl を過ぎたキーは自動的に削除され、処理中のロックも Redis で取るため複数のインスタンスで共有される。
+// ロックは IDEMPOTENCY_LOCK_TTL を過ぎると外れるため、リクエストの処理時間より長くしておく。
+// LRU キャッシュは件数 (IDEMPOTENCY_CACHE_SIZE) が上限に達すると ttl 内のキーでも古いものから追い出すため、
+// ttl の間に受け付ける冪等キーの数より大きくしておく。ロックもインスタンスごとになる
+func newIdempotencyStore(ttl time.Duration) (utils.Cache[string, middleware.IdempotentResponse], utils.Locker, error) {
+	if addr := os.Getenv("IDEMPOTENCY_REDIS_ADDR"); addr != "" {
+		rdb := redis.NewClient(&redis.Options{Addr: addr})
+		store := utils.NewRedisCacheWithExpiration[middleware.IdempotentResponse](*rdb, ttl)
+		return store, utils.NewRedisLocker(*rdb, envDuration("IDEMPOTENCY_LOCK_TTL", 30*time.Second)), nil
+	}
+	store, err := utils.NewInMemoryLRUCache[string, middleware.IdempotentResponse](envInt("IDEMPOTENCY_CACHE_SIZE", 10000))
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, utils.NewInMemoryLocker(), nil
+}
+
+func envInt(key string, defaultValue int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("Warning: invalid %s=%q. Using default %d", key, v, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// 一覧のカーソルの署名に使う鍵
+// 未設定の場合は起動ごとに生成するため、再起動前に発行したカーソルは使えなくなる
+func newCursorSigner() (*utils.CursorSigner, error) {
+	if secret := os.Getenv("CURSOR_SECRET"); secret != "" {
+		return utils.NewCursorSigner([]byte(secret)), nil
+	}
+	log.Println("Warning: CURSOR_SECRET is not set. Using a random secret; cursors will not survive restarts")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return utils.NewCursorSigner(secret), nil
+}
+
+// ロボットの署名鍵の導出に使う秘密鍵。DBには保存しない
+func newRobotSigningSecret() ([]byte, error) {
+	if secret := os.Getenv("ROBOT_SIGNING_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	log.Println("Warning: ROBOT_SIGNING_SECRET is not set. Using a random secret; issued signing keys will not survive restarts")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func envString(key, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+func envFloat(key string, defaultValue float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		log.Printf("Warning: invalid %s=%q. Using default %v", key, v, defaultValue)
+		return defaultValue
+	}
+	return f
+}
+
+func envBool(key string, defaultValue bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Warning: invalid %s=%q. Using default %v", key, v, defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+// 環境変数から time.Duration 形式 (例: "30s") の設定値を取得する
+func envDuration(key string, defaultValue time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid %s=%q. Using default %s", key, v, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
 func pproteinIntegrate(r *chi.Mux) {
 	EnableDebugMode(r)
 	EnableDebugHandler(r)
@@ -93,8 +278,13 @@ func (s *Server) setupRoutes(
 	productHandler *handler.ProductHandler,
 	orderHandler *handler.OrderHandler,
 	robotHandler *handler.RobotHandler,
+	deliveryPlanHandler *handler.DeliveryPlanHandler,
+	robotCredHandler *handler.RobotCredentialHandler,
+	webhookHandler *handler.WebhookHandler,
 	userAuthMW func(http.Handler) http.Handler,
 	robotAuthMW func(http.Handler) http.Handler,
+	adminAuthMW func(http.Handler) http.Handler,
+	idempotencyMW func(http.Handler) http.Handler,
 ) {
 	s.Router.Post("/api/login", authHandler.Login)
 
@@ -103,13 +293,42 @@ func (s *Server) setupRoutes(
 		r.Post("/product", productHandler.List)
 		r.Post("/product/post", productHandler.CreateOrders)
 		r.Post("/orders", orderHandler.List)
+		r.Get("/orders/export", orderHandler.Export)
+		r.Get("/orders/events", orderHandler.Events)
+		r.Get("/orders/{orderID}", orderHandler.Get)
+		r.Post("/orders/{orderID}/cancel", orderHandler.Cancel)
 		r.Get("/image", productHandler.GetImage)
 	})
 
 	s.Router.Route("/api/robot", func(r chi.Router) {
 		r.Use(robotAuthMW)
 		r.Get("/delivery-plan", robotHandler.GetDeliveryPlan)
-		r.Patch("/orders/status", robotHandler.UpdateOrderStatus)
+		r.Get("/delivery-plan/preview", robotHandler.PreviewDeliveryPlan)
+		r.With(idempotencyMW).Patch("/orders/status", robotHandler.UpdateOrderStatus)
+		r.With(idempotencyMW).Patch("/orders/statuses", robotHandler.UpdateOrderStatuses)
+		r.Get("/orders", robotHandler.GetRobotOrders)
+		r.Get("/stream", robotHandler.Stream)
+		r.Get("/delivery-plans", deliveryPlanHandler.List)
+		r.Get("/delivery-plans/{planID}", deliveryPlanHandler.Get)
+	})
+
+	// adminAuthMW が nil の場合は管理用APIを公開しない
+	if adminAuthMW == nil {
+		return
+	}
+	s.Router.Route("/api/admin", func(r chi.Router) {
+		r.Use(adminAuthMW)
+		r.Get("/robots/{robotID}/keys", robotCredHandler.List)
+		r.Post("/robots/{robotID}/keys", robotCredHandler.Issue)
+		r.Post("/robots/{robotID}/keys/rotate", robotCredHandler.Rotate)
+		r.Delete("/robots/{robotID}/keys/{keyID}", robotCredHandler.Revoke)
+		r.Get("/delivery-plans", deliveryPlanHandler.AdminList)
+		r.Get("/delivery-plans/{planID}", deliveryPlanHandler.AdminGet)
+		r.Get("/webhooks", webhookHandler.List)
+		r.Post("/webhooks", webhookHandler.Register)
+		r.Delete("/webhooks/{webhookID}", webhookHandler.Disable)
+		r.Get("/webhooks/deliveries", webhookHandler.ListDeliveries)
+		r.Post("/webhooks/deliveries/{deliveryID}/replay", webhookHandler.Replay)
 	})
 }
 
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/repository"
+	"context"
+	"database/sql"
+	"errors"
+)
+
+var ErrDeliveryPlanNotFound = errors.New("delivery plan not found")
+
+const (
+	defaultDeliveryPlanListLimit = 50
+	maxDeliveryPlanListLimit     = 200
+)
+
+type DeliveryPlanService struct {
+	store *repository.Store
+}
+
+func NewDeliveryPlanService(store *repository.Store) *DeliveryPlanService {
+	return &DeliveryPlanService{store: store}
+}
+
+// 配送計画の履歴を新しい順に取得
+func (s *DeliveryPlanService) ListPlans(ctx context.Context, robotID string, beforeID int64, limit int) ([]model.DeliveryPlanRecord, error) {
+	if limit <= 0 {
+		limit = defaultDeliveryPlanListLimit
+	}
+	if limit > maxDeliveryPlanListLimit {
+		limit = maxDeliveryPlanListLimit
+	}
+	return s.store.DeliveryPlanRepo.List(ctx, robotID, beforeID, limit)
+}
+
+// 配送計画の履歴を、含まれる注文の配送結果とともに取得
+func (s *DeliveryPlanService) GetPlan(ctx context.Context, planID int64) (*model.DeliveryPlanRecord, error) {
+	plan, err := s.store.DeliveryPlanRepo.FindByID(ctx, planID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrDeliveryPlanNotFound
+		}
+		return nil, err
+	}
+	return plan, nil
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"backend/internal/model"
+	"errors"
+)
+
+// 配送計画で明細をどの単位で選ぶか
+const (
+	// 明細の一部の数量だけを積むことを許す。一部だけ積んだ明細は割り当て時に分割する
+	GranularityUnit = "unit"
+	// 明細は全数量をまとめて積むか積まないかのどちらか
+	GranularityLine = "line"
+)
+
+var ErrUnknownGranularity = errors.New("unknown plan granularity")
+
+func validateGranularity(granularity string) error {
+	switch granularity {
+	case GranularityUnit, GranularityLine:
+		return nil
+	}
+	return ErrUnknownGranularity
+}
+
+// 明細の数量。数量を持たない注文は1個として扱う
+func units(o model.Order) int {
+	if o.Quantity <= 0 {
+		return 1
+	}
+	return o.Quantity
+}
+
+// 明細の一部の数量を表す候補
+type unitChunk struct {
+	line  model.Order
+	units int
+}
+
+// 各明細を 1, 2, 4, ... 個と残りの塊に分けた候補を返す (二進分割)
+// 塊を自由に組み合わせることで 0 から数量までの任意の個数を表せるため、
+// 0-1 ナップサックの optimizer で明細の一部の数量を選べる
+// 候補の注文IDは負の連番で、chunks から元の明細と個数を引ける
+func splitIntoUnitChunks(orders []model.Order) ([]model.Order, map[int64]unitChunk) {
+	candidates := make([]model.Order, 0, len(orders))
+	chunks := make(map[int64]unitChunk, len(orders))
+	for _, line := range orders {
+		q := units(line)
+		unitWeight, unitVolume, unitValue := line.Weight/q, line.Volume/q, line.Value/q
+		for size := 1; q > 0; size *= 2 {
+			n := size
+			if n > q {
+				n = q
+			}
+			q -= n
+
+			c := line
+			c.OrderID = -int64(len(chunks) + 1)
+			c.Quantity = n
+			c.Weight = unitWeight * n
+			c.Volume = unitVolume * n
+			c.Value = unitValue * n
+			chunks[c.OrderID] = unitChunk{line: line, units: n}
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates, chunks
+}
+
+// splitIntoUnitChunks の候補から作った配送計画を、明細ごとにまとめ直す
+// 明細の Quantity, Weight, Volume, Value, Priority は選ばれた個数分になる
+func mergeUnitChunks(plan *model.DeliveryPlan, chunks map[int64]unitChunk) {
+	merged := make([]model.Order, 0, len(plan.Orders))
+	index := make(map[int64]int, len(plan.Orders))
+	for _, c := range plan.Orders {
+		line := chunks[c.OrderID].line
+		i, ok := index[line.OrderID]
+		if !ok {
+			i = len(merged)
+			index[line.OrderID] = i
+			line.Quantity, line.Weight, line.Volume, line.Value, line.Priority = 0, 0, 0, 0, 0
+			line.Overdue = c.Overdue
+			merged = append(merged, line)
+		}
+		m := &merged[i]
+		m.Quantity += c.Quantity
+		m.Weight += c.Weight
+		m.Volume += c.Volume
+		m.Value += c.Value
+		m.Priority += c.Priority
+	}
+	plan.Orders = merged
+}
@@ -0,0 +1,354 @@
+package service
+
+import (
+	"backend/internal/model"
+	"errors"
+	"math"
+	"sort"
+)
+
+var ErrUnknownOptimizer = errors.New("unknown delivery plan optimizer")
+
+// 容量内で価値の合計が最大になる注文の組み合わせを選ぶアルゴリズム
+// 渡される注文はすべて単体で容量に収まることを前提とする
+type deliveryOptimizer interface {
+	Name() string
+	// 重さ以外の制約 (容積・個数) を扱えるか
+	// 扱えない場合は capacity.Weight のみを見る
+	MultiDimensional() bool
+	Select(orders []model.Order, capacity model.Capacity) []model.Order
+}
+
+const defaultOptimizer = "dp"
+
+// アルゴリズムを使わずに注文を選んだ場合に、配送計画の Strategy として記録する名前
+const (
+	// すべての候補が積載上限に収まった
+	StrategyAll = "all"
+	// 候補となる注文がなかった
+	StrategyNone = "none"
+)
+
+var optimizers = map[string]deliveryOptimizer{
+	"dp":               exactDPOptimizer{},
+	"branch_and_bound": branchAndBoundOptimizer{},
+	"greedy":           greedyOptimizer{},
+	"fptas":            fptasOptimizer{epsilon: 0.1},
+}
+
+func lookupOptimizer(name string) (deliveryOptimizer, error) {
+	o, ok := optimizers[name]
+	if !ok {
+		return nil, ErrUnknownOptimizer
+	}
+	return o, nil
+}
+
+// 厳密解 (動的計画法)
+// 計算量 O(n·capacity)。容量が大きいと遅い。重さのみに対応
+type exactDPOptimizer struct{}
+
+func (exactDPOptimizer) Name() string { return "dp" }
+
+func (exactDPOptimizer) MultiDimensional() bool { return false }
+
+func (exactDPOptimizer) Select(orders []model.Order, capacity model.Capacity) []model.Order {
+	return findBestSetRecursive(orders, capacity.Weight)
+}
+
+// 厳密解 (分枝限定法)
+// 価値密度順に探索し、各制約を正規化して足し合わせた代理制約の分数緩和を上界として枝刈りする
+// 容量の大きさに依存しないが、最悪計算量は指数時間のため、探索するノード数を maxBranchAndBoundNodes までに制限する
+// 上限に達した場合はそれまでに見つかった最良の解 (少なくとも貪欲法の解) を返す
+type branchAndBoundOptimizer struct{}
+
+// 分枝限定法で探索するノード数の上限
+const maxBranchAndBoundNodes = 1_000_000
+
+func (branchAndBoundOptimizer) Name() string { return "branch_and_bound" }
+
+func (branchAndBoundOptimizer) MultiDimensional() bool { return true }
+
+func (branchAndBoundOptimizer) Select(orders []model.Order, capacity model.Capacity) []model.Order {
+	items := sortByDensity(orders, capacity)
+	n := len(items)
+	usages := make([]float64, n)
+	for i, o := range items {
+		usages[i] = usage(o, capacity)
+	}
+	budget := float64(activeDimensions(capacity))
+
+	best := greedyOptimizer{}.Select(items, capacity)
+	bestValue := sumValue(best)
+
+	taken := make([]bool, n)
+	bestTaken := make([]bool, n)
+	useBest := false
+
+	// i 番目以降を代理制約の残りに分数で詰めた場合の価値の上界
+	upperBound := func(i int, used float64, value int) float64 {
+		bound := float64(value)
+		remaining := budget - used
+		for ; i < n; i++ {
+			if usages[i] <= remaining {
+				remaining -= usages[i]
+				bound += float64(items[i].Value)
+				continue
+			}
+			bound += float64(items[i].Value) * remaining / usages[i]
+			break
+		}
+		return bound
+	}
+
+	nodes := 0
+	var search func(i int, total model.Capacity, used float64, value int)
+	search = func(i int, total model.Capacity, used float64, value int) {
+		nodes++
+		if nodes > maxBranchAndBoundNodes {
+			return
+		}
+		if value > bestValue {
+			bestValue = value
+			copy(bestTaken, taken)
+			useBest = true
+		}
+		if i == n || upperBound(i, used, value) <= float64(bestValue) {
+			return
+		}
+		next := add(total, items[i])
+		if fits(next, capacity) {
+			taken[i] = true
+			search(i+1, next, used+usages[i], value+items[i].Value)
+			taken[i] = false
+		}
+		search(i+1, total, used, value)
+	}
+	search(0, model.Capacity{}, 0, 0)
+
+	if !useBest {
+		return best
+	}
+	result := make([]model.Order, 0)
+	for i, t := range bestTaken {
+		if t {
+			result = append(result, items[i])
+		}
+	}
+	return result
+}
+
+// 近似解 (貪欲法)
+// 価値密度順に詰めた解と、単体で最も価値の高い注文のうち良い方を返す
+// 重さのみの場合は最適値の 1/2 以上が保証される。計算量 O(n log n)
+type greedyOptimizer struct{}
+
+func (greedyOptimizer) Name() string { return "greedy" }
+
+func (greedyOptimizer) MultiDimensional() bool { return true }
+
+func (greedyOptimizer) Select(orders []model.Order, capacity model.Capacity) []model.Order {
+	items := sortByDensity(orders, capacity)
+
+	result := make([]model.Order, 0)
+	var total model.Capacity
+	value := 0
+	for _, o := range items {
+		if next := add(total, o); fits(next, capacity) {
+			result = append(result, o)
+			total = next
+			value += o.Value
+		}
+	}
+
+	for _, o := range items {
+		if fits(add(model.Capacity{}, o), capacity) && o.Value > value {
+			result = []model.Order{o}
+			value = o.Value
+		}
+	}
+	return result
+}
+
+// 近似解 (FPTAS)
+// 価値をスケーリングして価値軸の動的計画法を解く。最適値の (1-epsilon) 倍以上が保証される
+// 貪欲法の解を下界に使ってスケールを決めるため、計算量は容量に依存せず O(n²/epsilon)、メモリは O(n/epsilon)。重さのみに対応
+type fptasOptimizer struct {
+	epsilon float64
+}
+
+func (fptasOptimizer) Name() string { return "fptas" }
+
+func (fptasOptimizer) MultiDimensional() bool { return false }
+
+func (f fptasOptimizer) Select(orders []model.Order, capacity model.Capacity) []model.Order {
+	weightOnly := model.Capacity{Weight: capacity.Weight}
+	greedy := greedyOptimizer{}.Select(orders, weightOnly)
+	lowerBound := sumValue(greedy)
+	n := len(orders)
+	if n == 0 || lowerBound == 0 {
+		return greedy
+	}
+
+	// 最適値は 2*lowerBound 以下なので、スケール後の価値の合計は maxProfit 以下に収まる
+	scale := f.epsilon * float64(lowerBound) / float64(n)
+	if scale < 1 {
+		scale = 1
+	}
+	maxProfit := int(2 * float64(lowerBound) / scale)
+	scaled := make([]int, n)
+	for i, o := range orders {
+		scaled[i] = int(float64(o.Value) / scale)
+	}
+
+	minWeight := minWeightByProfit(orders, scaled, maxProfit, capacity.Weight)
+	best := 0
+	for p := maxProfit; p > 0; p-- {
+		if minWeight[p] <= capacity.Weight {
+			best = p
+			break
+		}
+	}
+
+	// 注文ごとの選択を記録すると O(n·maxProfit) のメモリが必要になるため、分割統治で解を復元する
+	result := reconstructByProfit(orders, scaled, best, minWeight[best], make([]model.Order, 0))
+	if sumValue(result) < lowerBound {
+		return greedy
+	}
+	return result
+}
+
+// スケール後の価値ちょうど p を達成する最小の重さを p = 0..maxProfit について返す
+// limit を超える重さや達成できない価値は math.MaxInt とする
+func minWeightByProfit(orders []model.Order, scaled []int, maxProfit, limit int) []int {
+	minWeight := make([]int, maxProfit+1)
+	for p := 1; p <= maxProfit; p++ {
+		minWeight[p] = math.MaxInt
+	}
+	for i, o := range orders {
+		for p := maxProfit; p >= scaled[i]; p-- {
+			prev := minWeight[p-scaled[i]]
+			if prev == math.MaxInt || prev+o.Weight > limit {
+				continue
+			}
+			if prev+o.Weight < minWeight[p] {
+				minWeight[p] = prev + o.Weight
+			}
+		}
+	}
+	return minWeight
+}
+
+// スケール後の価値の合計がちょうど target で、重さの合計が limit 以下になる注文を result に追加して返す
+// 注文を半分に分けてそれぞれの価値ごとの最小の重さを求め、target の配分を決めてから再帰する
+// 各段の配列は target の大きさで済むため、メモリは O(maxProfit + n)
+func reconstructByProfit(orders []model.Order, scaled []int, target, limit int, result []model.Order) []model.Order {
+	if target == 0 || len(orders) == 0 {
+		return result
+	}
+	if len(orders) == 1 {
+		if scaled[0] == target {
+			result = append(result, orders[0])
+		}
+		return result
+	}
+
+	mid := len(orders) / 2
+	left := minWeightByProfit(orders[:mid], scaled[:mid], target, limit)
+	right := minWeightByProfit(orders[mid:], scaled[mid:], target, limit)
+	split, splitWeight := -1, math.MaxInt
+	for p := 0; p <= target; p++ {
+		if left[p] == math.MaxInt || right[target-p] == math.MaxInt {
+			continue
+		}
+		if w := left[p] + right[target-p]; w < splitWeight {
+			split, splitWeight = p, w
+		}
+	}
+	if split < 0 {
+		return result
+	}
+	result = reconstructByProfit(orders[:mid], scaled[:mid], split, left[split], result)
+	return reconstructByProfit(orders[mid:], scaled[mid:], target-split, right[target-split], result)
+}
+
+// 重さ以外の制約が指定されているか
+func isMultiDimensional(capacity model.Capacity) bool {
+	return capacity.Volume > 0 || capacity.Items > 0
+}
+
+func activeDimensions(capacity model.Capacity) int {
+	n := 1
+	if capacity.Volume > 0 {
+		n++
+	}
+	if capacity.Items > 0 {
+		n++
+	}
+	return n
+}
+
+// 注文を積んだ後の積載量を返す
+func add(total model.Capacity, o model.Order) model.Capacity {
+	return model.Capacity{
+		Weight: total.Weight + o.Weight,
+		Volume: total.Volume + o.Volume,
+		Items:  total.Items + units(o),
+	}
+}
+
+// 積載量 total がすべての制約を満たすか
+func fits(total, capacity model.Capacity) bool {
+	if total.Weight > capacity.Weight {
+		return false
+	}
+	if capacity.Volume > 0 && total.Volume > capacity.Volume {
+		return false
+	}
+	if capacity.Items > 0 && total.Items > capacity.Items {
+		return false
+	}
+	return true
+}
+
+// 注文が各制約の上限に占める割合の合計
+func usage(o model.Order, capacity model.Capacity) float64 {
+	u := 0.0
+	if capacity.Weight > 0 {
+		u += float64(o.Weight) / float64(capacity.Weight)
+	}
+	if capacity.Volume > 0 {
+		u += float64(o.Volume) / float64(capacity.Volume)
+	}
+	if capacity.Items > 0 {
+		u += float64(units(o)) / float64(capacity.Items)
+	}
+	return u
+}
+
+// 価値密度 (価値 / 制約の使用割合) の降順に並べたコピーを返す
+func sortByDensity(orders []model.Order, capacity model.Capacity) []model.Order {
+	items := make([]model.Order, len(orders))
+	copy(items, orders)
+	sort.SliceStable(items, func(i, j int) bool {
+		return density(items[i], capacity) > density(items[j], capacity)
+	})
+	return items
+}
+
+// 制約を消費しない注文は密度無限大として扱う
+func density(o model.Order, capacity model.Capacity) float64 {
+	u := usage(o, capacity)
+	if u == 0 {
+		return math.Inf(1)
+	}
+	return float64(o.Value) / u
+}
+
+func sumValue(orders []model.Order) int {
+	total := 0
+	for _, o := range orders {
+		total += o.Value
+	}
+	return total
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"backend/internal/model"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+// 全探索で最適な価値の合計を求める
+func bruteForceBestValue(orders []model.Order, capacity model.Capacity) int {
+	best := 0
+	for mask := 0; mask < 1<<len(orders); mask++ {
+		var total model.Capacity
+		value := 0
+		for i, o := range orders {
+			if mask&(1<<i) != 0 {
+				total = add(total, o)
+				value += o.Value
+			}
+		}
+		if fits(total, capacity) && value > best {
+			best = value
+		}
+	}
+	return best
+}
+
+// 単体で容量に収まる注文をランダムに生成する
+func randomOrders(r *rand.Rand, n int, capacity model.Capacity) []model.Order {
+	orders := make([]model.Order, n)
+	for i := range orders {
+		o := model.Order{
+			OrderID:  int64(i + 1),
+			Weight:   1 + r.IntN(capacity.Weight),
+			Value:    r.IntN(100),
+			Quantity: 1,
+		}
+		if capacity.Volume > 0 {
+			o.Volume = r.IntN(capacity.Volume + 1)
+		}
+		if capacity.Items > 0 {
+			o.Quantity = 1 + r.IntN(capacity.Items)
+		}
+		orders[i] = o
+	}
+	return orders
+}
+
+// 選ばれた注文が入力に含まれ、重複せず、容量に収まっていることを確認する
+func checkSelection(t *testing.T, name string, orders, selected []model.Order, capacity model.Capacity) {
+	t.Helper()
+	ids := make(map[int64]bool, len(orders))
+	for _, o := range orders {
+		ids[o.OrderID] = true
+	}
+	var total model.Capacity
+	for _, o := range selected {
+		if !ids[o.OrderID] {
+			t.Fatalf("%s selected order %d which is not a candidate or is selected twice", name, o.OrderID)
+		}
+		delete(ids, o.OrderID)
+		total = add(total, o)
+	}
+	if !fits(total, capacity) {
+		t.Fatalf("%s exceeded capacity: total %+v, capacity %+v", name, total, capacity)
+	}
+}
+
+// 厳密解のアルゴリズムは全探索と同じ最適値を返すこと
+func TestExactOptimizersMatchBruteForce(t *testing.T) {
+	tests := []struct {
+		name      string
+		optimizer deliveryOptimizer
+		// 重さ以外の制約も与えるか
+		multiDimensional bool
+	}{
+		{"dp", exactDPOptimizer{}, false},
+		{"branch_and_bound", branchAndBoundOptimizer{}, false},
+		{"branch_and_bound/multi_dimensional", branchAndBoundOptimizer{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := rand.New(rand.NewPCG(1, 2))
+			for i := 0; i < 200; i++ {
+				capacity := model.Capacity{Weight: 1 + r.IntN(50)}
+				if tt.multiDimensional {
+					capacity.Volume = 1 + r.IntN(50)
+					capacity.Items = 1 + r.IntN(5)
+				}
+				orders := randomOrders(r, r.IntN(11), capacity)
+
+				selected := tt.optimizer.Select(orders, capacity)
+				checkSelection(t, tt.name, orders, selected, capacity)
+				if got, want := sumValue(selected), bruteForceBestValue(orders, capacity); got != want {
+					t.Fatalf("case %d: value = %d, want optimum %d (orders %+v, capacity %+v)", i, got, want, orders, capacity)
+				}
+			}
+		})
+	}
+}
+
+// 近似解のアルゴリズムは容量に収まり、保証された比率以上の価値を返すこと
+func TestApproximateOptimizersRatio(t *testing.T) {
+	tests := []struct {
+		name      string
+		optimizer deliveryOptimizer
+		minRatio  float64
+	}{
+		{"greedy", greedyOptimizer{}, 0.5},
+		{"fptas", fptasOptimizer{epsilon: 0.1}, 0.9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := rand.New(rand.NewPCG(3, 4))
+			for i := 0; i < 200; i++ {
+				capacity := model.Capacity{Weight: 1 + r.IntN(50)}
+				orders := randomOrders(r, r.IntN(11), capacity)
+
+				selected := tt.optimizer.Select(orders, capacity)
+				checkSelection(t, tt.name, orders, selected, capacity)
+				got, want := sumValue(selected), bruteForceBestValue(orders, capacity)
+				if float64(got) < tt.minRatio*float64(want) {
+					t.Fatalf("case %d: value = %d, want at least %.2f of optimum %d", i, got, tt.minRatio, want)
+				}
+			}
+		})
+	}
+}
+
+// スケール後の価値の上限が 64 を大きく超える入力でも、FPTAS の解が保証を満たすこと
+func TestFPTASLargeProfits(t *testing.T) {
+	r := rand.New(rand.NewPCG(5, 6))
+	capacity := model.Capacity{Weight: 2000}
+	orders := make([]model.Order, 200)
+	for i := range orders {
+		orders[i] = model.Order{OrderID: int64(i + 1), Weight: 1 + r.IntN(200), Value: 100 + r.IntN(10000), Quantity: 1}
+	}
+
+	f := fptasOptimizer{epsilon: 0.1}
+	lowerBound := sumValue(greedyOptimizer{}.Select(orders, capacity))
+	scale := max(f.epsilon*float64(lowerBound)/float64(len(orders)), 1)
+	if maxProfit := int(2 * float64(lowerBound) / scale); maxProfit <= 64 {
+		t.Fatalf("maxProfit = %d, want the fixture to exceed 64", maxProfit)
+	}
+
+	selected := f.Select(orders, capacity)
+	checkSelection(t, "fptas", orders, selected, capacity)
+	want := sumValue(exactDPOptimizer{}.Select(orders, capacity))
+	if got := sumValue(selected); float64(got) < (1-f.epsilon)*float64(want) {
+		t.Errorf("fptas value = %d, want at least %.2f of optimum %d", got, 1-f.epsilon, want)
+	}
+}
+
+// 分割統治で復元した注文は、指定した価値ちょうどを最小の重さで達成すること
+func TestReconstructByProfit(t *testing.T) {
+	r := rand.New(rand.NewPCG(7, 8))
+	const limit = 1000
+	orders := make([]model.Order, 100)
+	scaled := make([]int, len(orders))
+	maxProfit := 0
+	for i := range orders {
+		orders[i] = model.Order{OrderID: int64(i + 1), Weight: 1 + r.IntN(100)}
+		scaled[i] = r.IntN(50)
+		maxProfit += scaled[i]
+	}
+
+	minWeight := minWeightByProfit(orders, scaled, maxProfit, limit)
+	reachable := 0
+	for target := 0; target <= maxProfit; target++ {
+		if minWeight[target] == math.MaxInt {
+			continue
+		}
+		reachable++
+		result := reconstructByProfit(orders, scaled, target, minWeight[target], nil)
+		profit, weight := 0, 0
+		for _, o := range result {
+			profit += scaled[o.OrderID-1]
+			weight += o.Weight
+		}
+		if profit != target || weight != minWeight[target] {
+			t.Fatalf("target %d: got profit %d weight %d, want weight %d", target, profit, weight, minWeight[target])
+		}
+	}
+	if reachable <= 64 {
+		t.Fatalf("only %d profits are reachable, want more than 64", reachable)
+	}
+}
+
+// 探索ノード数の上限に達しても、容量に収まり貪欲法以上の解を返すこと
+func TestBranchAndBoundNodeLimit(t *testing.T) {
+	r := rand.New(rand.NewPCG(9, 10))
+	capacity := model.Capacity{Weight: 1000, Volume: 1000, Items: 100}
+	// 価値密度がほぼ等しいと上界による枝刈りが効かず、探索が指数的に増える
+	orders := make([]model.Order, 80)
+	for i := range orders {
+		w := 20 + r.IntN(30)
+		orders[i] = model.Order{OrderID: int64(i + 1), Weight: w, Volume: w, Value: 2*w + r.IntN(2), Quantity: 1}
+	}
+
+	selected := branchAndBoundOptimizer{}.Select(orders, capacity)
+	checkSelection(t, "branch_and_bound", orders, selected, capacity)
+	if got, greedy := sumValue(selected), sumValue(greedyOptimizer{}.Select(orders, capacity)); got < greedy {
+		t.Errorf("branch_and_bound value = %d, want at least greedy %d", got, greedy)
+	}
+}
@@ -1,11 +1,18 @@
 package service
 
 import (
+	cache "backend/internal"
 	"backend/internal/model"
 	"backend/internal/repository"
+	"backend/internal/utils"
 	"context"
+	"database/sql"
+	"errors"
 )
 
+// カーソルが別の一覧や別のソート条件に対して発行されたもの
+var ErrInvalidCursor = errors.New("cursor does not match the list request")
+
 type OrderService struct {
 	store *repository.Store
 }
@@ -15,12 +22,123 @@ func NewOrderService(store *repository.Store) *OrderService {
 }
 
 // ユーザーの注文履歴を取得
-func (s *OrderService) FetchOrders(ctx context.Context, userID int, req model.ListRequest) ([]model.Order, int, error) {
-	var orders []model.Order
-	var total int
-	orders, total, fetchErr := s.store.OrderRepo.ListOrders(ctx, userID, req)
-	if fetchErr != nil {
-		return nil, 0, fetchErr
-	}
-	return orders, total, nil
+// ページが埋まっていれば、続きを取得するためのカーソルも返す
+func (s *OrderService) FetchOrders(ctx context.Context, userID int, req model.ListRequest) ([]model.Order, int, *model.ListCursor, error) {
+	if req.After != nil && !repository.CursorMatches(*req.After, repository.OrderCursorScope, req) {
+		return nil, 0, nil, ErrInvalidCursor
+	}
+	orders, total, err := s.store.OrderRepo.ListOrders(ctx, userID, req)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return orders, total, repository.NextOrderCursor(orders, req), nil
+}
+
+// ユーザーの注文履歴を絞り込み条件に合うものすべて、作成順に少しずつ fn に渡す
+func (s *OrderService) ExportOrders(ctx context.Context, userID int, req model.ListRequest, fn func([]model.Order) error) error {
+	return s.store.OrderRepo.ExportOrders(ctx, userID, req, fn)
+}
+
+// ユーザーの注文履歴を親注文ごとにまとめて取得
+func (s *OrderService) FetchOrderGroups(ctx context.Context, userID int, req model.ListRequest) ([]model.OrderGroup, int, error) {
+	return s.store.OrderRepo.ListOrderGroups(ctx, userID, req)
+}
+
+// 最後に配信した注文ステータスの変更イベントのID
+func (s *OrderService) LatestOrderEventID() int64 {
+	return cache.OrderEvents.LastID()
+}
+
+// afterID より後のユーザーの注文ステータスの変更イベントと、次の変更で close されるチャネルを返す
+// afterID 以降のイベントを取りこぼしている可能性があれば complete は false になる
+func (s *OrderService) OrderEventsSince(userID int, afterID int64) ([]utils.Event[model.UserOrderEvent], bool, <-chan struct{}) {
+	return cache.OrderEvents.Since(userID, afterID)
+}
+
+// ユーザーの注文をキャンセルする
+// キャンセルできるのは配送待ち(shipping)の注文のみで、それ以外は ErrInvalidStatusTransition を返す
+// 他のユーザーの注文は存在しないものとして ErrOrderNotFound を返す
+func (s *OrderService) CancelOrder(ctx context.Context, userID int, orderID int64) error {
+	// 判定は行ロックを取った注文に対して行うため、配送計画による割り当てと競合しない
+	// ステータスの更新・履歴の記録・在庫の戻しを1つのトランザクションで行い、
+	// キャッシュの注文と在庫はコミットが成功してからまとめて反映する
+	var results map[int64]error
+	err := s.store.ExecTx(ctx, func(txStore *repository.Store) error {
+		var err error
+		results, err = txStore.OrderRepo.TransitionStatuses(ctx, []int64{orderID}, "cancelled", func(current model.Order) error {
+			if current.UserID != userID {
+				return ErrOrderNotFound
+			}
+			if !canTransition(current.ShippedStatus, "cancelled") {
+				return ErrInvalidStatusTransition
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if errors.Is(results[orderID], sql.ErrNoRows) {
+		return ErrOrderNotFound
+	}
+	return results[orderID]
+}
+
+// ユーザーの注文の詳細を、商品情報とステータスの変更履歴とともに取得
+// 他のユーザーの注文は存在しないものとして ErrOrderNotFound を返す
+func (s *OrderService) GetOrderDetail(ctx context.Context, userID int, orderID int64) (*model.OrderDetail, error) {
+	order, err := s.store.OrderRepo.FindByID(ctx, orderID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrOrderNotFound
+		}
+		return nil, err
+	}
+	if order.UserID != userID {
+		return nil, ErrOrderNotFound
+	}
+
+	product, err := s.store.ProductRepo.FindByID(ctx, order.ProductID)
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.store.OrderRepo.GetStatusHistory(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &model.OrderDetail{
+		OrderID:       order.OrderID,
+		ShippedStatus: order.ShippedStatus,
+		GroupID:       order.GroupID,
+		Quantity:      order.Quantity,
+		CreatedAt:     order.CreatedAt,
+		Product:       product,
+		Timeline:      completeTimeline(order, history),
+	}
+	if order.ArrivedAt.Valid {
+		arrivedAt := order.ArrivedAt.Time
+		detail.ArrivedAt = &arrivedAt
+	}
+	return detail, nil
+}
+
+// 履歴の記録を始める前に作られた注文は履歴が欠けているため、作成日時と到着日時から補う
+func completeTimeline(order model.Order, history []model.OrderStatusEvent) []model.OrderStatusEvent {
+	timeline := make([]model.OrderStatusEvent, 0, len(history)+2)
+	if len(history) == 0 || history[0].ChangedAt.After(order.CreatedAt) {
+		timeline = append(timeline, model.OrderStatusEvent{OrderID: order.OrderID, Status: "shipping", ChangedAt: order.CreatedAt})
+	}
+	timeline = append(timeline, history...)
+
+	if order.ArrivedAt.Valid {
+		for _, e := range history {
+			if e.Status == "completed" {
+				return timeline
+			}
+		}
+		timeline = append(timeline, model.OrderStatusEvent{OrderID: order.OrderID, Status: "completed", ChangedAt: order.ArrivedAt.Time})
+	}
+	return timeline
 }
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"backend/internal/model"
+	"math"
+	"sort"
+	"time"
+)
+
+// 配送計画で注文を選ぶ際の優先度モデル
+// 価値の合計だけを最大化すると低価値の注文がいつまでも選ばれないため、待ち時間に応じて優先度を上げる
+type PriorityConfig struct {
+	// 待ち時間1時間あたりに価値へ上乗せする割合 (0.1 なら1時間で価値の1.1倍)。0 で無効
+	AgingRatePerHour float64
+	// この時間を超えて待っている注文は優先度に関係なく計画に含める。0 で無効
+	Deadline time.Duration
+}
+
+// 各注文の実効優先度 (Priority) と期限超過 (Overdue) を設定したコピーを返す
+func (c PriorityConfig) apply(orders []model.Order, now time.Time) []model.Order {
+	result := make([]model.Order, len(orders))
+	for i, o := range orders {
+		age := now.Sub(o.CreatedAt)
+		if age < 0 {
+			age = 0
+		}
+		o.Priority = int(math.Round(float64(o.Value) * (1 + c.AgingRatePerHour*age.Hours())))
+		o.Overdue = c.Deadline > 0 && age > c.Deadline
+		result[i] = o
+	}
+	return result
+}
+
+// 期限超過の注文を古い順に容量の許す限り選び、選んだ注文と積載量を返す
+func takeOverdue(orders []model.Order, capacity model.Capacity) ([]model.Order, model.Capacity) {
+	overdue := make([]model.Order, 0)
+	for _, o := range orders {
+		if o.Overdue {
+			overdue = append(overdue, o)
+		}
+	}
+	sort.SliceStable(overdue, func(i, j int) bool {
+		return overdue[i].CreatedAt.Before(overdue[j].CreatedAt)
+	})
+
+	var used model.Capacity
+	taken := make([]model.Order, 0, len(overdue))
+	for _, o := range overdue {
+		if next := add(used, o); fits(next, capacity) {
+			taken = append(taken, o)
+			used = next
+		}
+	}
+	return taken, used
+}
+
+// capacity から used を差し引いた残りの積載上限を返す
+// 制限なし (0) の次元は制限なしのまま残す
+func subtract(capacity, used model.Capacity) model.Capacity {
+	rest := model.Capacity{Weight: capacity.Weight - used.Weight}
+	if capacity.Volume > 0 {
+		rest.Volume = capacity.Volume - used.Volume
+	}
+	if capacity.Items > 0 {
+		rest.Items = capacity.Items - used.Items
+	}
+	return rest
+}
@@ -2,12 +2,30 @@ package service
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 
 	"backend/internal/model"
 	"backend/internal/repository"
 )
 
+// 注文リクエストの上限
+const (
+	maxOrderRequestItems = 100
+	maxOrderItemQuantity = 1000
+)
+
+// 注文リクエストの検証エラー。不正な明細をすべて含む
+type OrderValidationError struct {
+	Errors []model.OrderItemError
+}
+
+func (e *OrderValidationError) Error() string {
+	return fmt.Sprintf("invalid order request: %d error(s)", len(e.Errors))
+}
+
 type ProductService struct {
 	store *repository.Store
 }
@@ -16,36 +34,166 @@ func NewProductService(store *repository.Store) *ProductService {
 	return &ProductService{store: store}
 }
 
-func (s *ProductService) CreateOrders(ctx context.Context, userID int, items []model.RequestItem) ([]string, error) {
+// 注文リクエストを検証し、不正な明細があれば *OrderValidationError を返す
+func (s *ProductService) validateOrderItems(ctx context.Context, items []model.RequestItem) error {
+	var itemErrors []model.OrderItemError
+	if len(items) > maxOrderRequestItems {
+		itemErrors = append(itemErrors, model.OrderItemError{
+			Reason:  "too_many_items",
+			Message: fmt.Sprintf("at most %d items can be ordered at once", maxOrderRequestItems),
+		})
+	}
+	// 同じ商品の明細は1つにまとめるため、数量の上限は商品ごとの合計に適用する
+	totals := make(map[int]int, len(items))
+	// 在庫の確認でも使うため、商品は1度だけ取得する。found は存在しない商品も false として記録する
+	products := make(map[int]model.Product, len(items))
+	found := make(map[int]bool, len(items))
+	for i, item := range items {
+		index := i
+		itemError := model.OrderItemError{Index: &index, ProductID: item.ProductID, Quantity: item.Quantity}
+		if _, looked := found[item.ProductID]; !looked {
+			p, err := s.store.ProductRepo.FindByID(ctx, item.ProductID)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			products[item.ProductID] = p
+			found[item.ProductID] = err == nil
+		}
+		if !found[item.ProductID] {
+			itemError.Reason = "unknown_product"
+			itemError.Message = fmt.Sprintf("product %d does not exist", item.ProductID)
+			itemErrors = append(itemErrors, itemError)
+			continue
+		}
+		switch {
+		case item.Quantity <= 0:
+			itemError.Reason = "invalid_quantity"
+			itemError.Message = "quantity must be positive"
+			itemErrors = append(itemErrors, itemError)
+		case totals[item.ProductID]+item.Quantity > maxOrderItemQuantity:
+			itemError.Reason = "quantity_too_large"
+			itemError.Message = fmt.Sprintf("total quantity per product must be at most %d", maxOrderItemQuantity)
+			itemErrors = append(itemErrors, itemError)
+		default:
+			totals[item.ProductID] += item.Quantity
+		}
+	}
+	if len(itemErrors) > 0 {
+		return &OrderValidationError{Errors: itemErrors}
+	}
+
+	// 在庫はここで確認した後にも変わりうるため、最終的な確認は注文の作成時に行う
+	shortages := make([]repository.StockShortage, 0)
+	for _, productID := range firstIndexOrder(items) {
+		p := products[productID]
+		if totals[productID] > p.Stock {
+			shortages = append(shortages, repository.StockShortage{ProductID: productID, Requested: totals[productID], Available: p.Stock})
+		}
+	}
+	itemErrors = outOfStockErrors(items, shortages)
+	if len(itemErrors) > 0 {
+		return &OrderValidationError{Errors: itemErrors}
+	}
+	return nil
+}
+
+// リクエストに含まれる商品IDを、最初に現れた順に返す
+func firstIndexOrder(items []model.RequestItem) []int {
+	seen := make(map[int]struct{}, len(items))
+	ids := make([]int, 0, len(items))
+	for _, item := range items {
+		if _, ok := seen[item.ProductID]; !ok {
+			seen[item.ProductID] = struct{}{}
+			ids = append(ids, item.ProductID)
+		}
+	}
+	return ids
+}
+
+// 在庫が足りない商品を、その商品が最初に現れた明細のエラーとして返す
+func outOfStockErrors(items []model.RequestItem, shortages []repository.StockShortage) []model.OrderItemError {
+	itemErrors := make([]model.OrderItemError, 0, len(shortages))
+	for _, shortage := range shortages {
+		index := -1
+		for i, item := range items {
+			if item.ProductID == shortage.ProductID {
+				index = i
+				break
+			}
+		}
+		available := shortage.Available
+		itemErrors = append(itemErrors, model.OrderItemError{
+			Index:     &index,
+			ProductID: shortage.ProductID,
+			Quantity:  shortage.Requested,
+			Available: &available,
+			Reason:    "out_of_stock",
+			Message:   fmt.Sprintf("only %d left in stock for product %d", shortage.Available, shortage.ProductID),
+		})
+	}
+	return itemErrors
+}
+
+// 注文を作成する。同じ商品の注文は数量をまとめて1つの明細にし、全明細を1つの親注文にまとめる
+// リクエストに不正な明細や在庫の足りない商品が1つでもあれば、何も作成せずに *OrderValidationError を返す
+func (s *ProductService) CreateOrders(ctx context.Context, userID int, items []model.RequestItem) (int64, []string, error) {
 	var insertedOrderIDs []string
 
+	if err := s.validateOrderItems(ctx, items); err != nil {
+		return 0, nil, err
+	}
+
 	orders := make([]*model.Order, 0)
+	byProduct := make(map[int]*model.Order)
 
 	for _, item := range items {
-		if item.Quantity > 0 {
-			for i := 0; i < item.Quantity; i++ {
-				order := &model.Order{
-					UserID:    userID,
-					ProductID: item.ProductID,
-				}
-				orders = append(orders, order)
-			}
+		if order, ok := byProduct[item.ProductID]; ok {
+			order.Quantity += item.Quantity
+			continue
+		}
+		order := &model.Order{
+			UserID:    userID,
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
 		}
+		byProduct[item.ProductID] = order
+		orders = append(orders, order)
 	}
 
+	var groupID int64
 	if len(orders) != 0 {
-		ids, err := s.store.OrderRepo.CreateMany(ctx, orders)
+		// 在庫の確保と注文の作成を1つのトランザクションで行う
+		err := s.store.ExecTx(ctx, func(txStore *repository.Store) error {
+			ids, err := txStore.OrderRepo.CreateMany(ctx, orders)
+			if err != nil {
+				return err
+			}
+			insertedOrderIDs = ids
+			return nil
+		})
 		if err != nil {
-			return nil, err
+			var stockErr *repository.OutOfStockError
+			if errors.As(err, &stockErr) {
+				return 0, nil, &OrderValidationError{Errors: outOfStockErrors(items, stockErr.Shortages)}
+			}
+			return 0, nil, err
 		}
-		insertedOrderIDs = ids
+		groupID = orders[0].GroupID
 	}
 
 	log.Printf("Created %d orders for user %d", len(insertedOrderIDs), userID)
-	return insertedOrderIDs, nil
+	return groupID, insertedOrderIDs, nil
 }
 
-func (s *ProductService) FetchProducts(ctx context.Context, userID int, req model.ListRequest) ([]model.Product, int, error) {
+// 商品一覧を取得
+// ページが埋まっていれば、続きを取得するためのカーソルも返す
+func (s *ProductService) FetchProducts(ctx context.Context, userID int, req model.ListRequest) ([]model.Product, int, *model.ListCursor, error) {
+	if req.After != nil && !repository.CursorMatches(*req.After, repository.ProductCursorScope, req) {
+		return nil, 0, nil, ErrInvalidCursor
+	}
 	products, total, err := s.store.ProductRepo.ListProducts(ctx, userID, req)
-	return products, total, err
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return products, total, repository.NextProductCursor(products, req), nil
 }
@@ -1,120 +1,528 @@
 package service
 
 import (
+	cache "backend/internal"
 	"backend/internal/model"
 	"backend/internal/repository"
 	"backend/internal/service/utils"
 	"context"
+	"database/sql"
+	"errors"
 	"log"
+	"sync"
+	"time"
 )
 
 const (
 	smallProblemThreshold = 20000
 )
 
+type RobotConfig struct {
+	// ロボットに割り当てた注文のリース期間
+	LeaseDuration time.Duration
+	// 期限切れリースを回収する間隔
+	LeaseReapInterval time.Duration
+	// 配送計画の取得時に shipping の注文が現れるのを待つ最大時間
+	PlanMaxWait time.Duration
+	// 指定がない場合に使う注文選択アルゴリズム (dp, branch_and_bound, greedy, fptas)
+	DefaultOptimizer string
+	// 指定がない場合に明細を選ぶ単位 (unit, line)
+	DefaultGranularity string
+	// 注文の待ち時間に応じた優先度モデル
+	Priority PriorityConfig
+}
+
 type RobotService struct {
-	store *repository.Store
+	store  *repository.Store
+	config RobotConfig
+	// 複数ロボットに同じ注文が割り当てられないよう、配送計画の生成を直列化する
+	planMu sync.Mutex
+}
+
+func NewRobotService(store *repository.Store, config RobotConfig) *RobotService {
+	if _, err := lookupOptimizer(config.DefaultOptimizer); err != nil {
+		log.Printf("Warning: unknown optimizer %q. Using %q", config.DefaultOptimizer, defaultOptimizer)
+		config.DefaultOptimizer = defaultOptimizer
+	}
+	if err := validateGranularity(config.DefaultGranularity); err != nil {
+		log.Printf("Warning: unknown plan granularity %q. Using %q", config.DefaultGranularity, GranularityUnit)
+		config.DefaultGranularity = GranularityUnit
+	}
+	return &RobotService{store: store, config: config}
+}
+
+// 注文選択アルゴリズム名を検証する。空文字列は設定のデフォルトを意味する
+func (s *RobotService) ValidateStrategy(strategy string) error {
+	if strategy == "" {
+		return nil
+	}
+	_, err := lookupOptimizer(strategy)
+	return err
 }
 
-func NewRobotService(store *repository.Store) *RobotService {
-	return &RobotService{store: store}
+// 明細を選ぶ単位を検証する。空文字列は設定のデフォルトを意味する
+func (s *RobotService) ValidateGranularity(granularity string) error {
+	if granularity == "" {
+		return nil
+	}
+	return validateGranularity(granularity)
 }
 
-func (s *RobotService) GenerateDeliveryPlan(ctx context.Context, robotID string, capacity int) (*model.DeliveryPlan, error) {
+// 配送計画を生成し、選ばれた注文をロボットに割り当てる
+// strategy が空の場合は設定の DefaultOptimizer を使う。未知の strategy は ErrUnknownOptimizer を返す
+// granularity が unit の場合、一部の数量だけを積む明細は積む分と残りに分割してから割り当てる
+func (s *RobotService) GenerateDeliveryPlan(ctx context.Context, robotID string, capacity model.Capacity, strategy, granularity string) (*model.DeliveryPlan, error) {
 	var plan model.DeliveryPlan
 
-	err := s.store.ExecTx(ctx, func(txStore *repository.Store) error {
+	if strategy == "" {
+		strategy = s.config.DefaultOptimizer
+	}
+	optimizer, err := lookupOptimizer(strategy)
+	if err != nil {
+		return nil, err
+	}
+	if granularity == "" {
+		granularity = s.config.DefaultGranularity
+	}
+	if err := validateGranularity(granularity); err != nil {
+		return nil, err
+	}
+
+	s.planMu.Lock()
+	defer s.planMu.Unlock()
+
+	err = s.store.ExecTx(ctx, func(txStore *repository.Store) error {
 		orders, err := txStore.OrderRepo.GetShippingOrders(ctx)
 		if err != nil {
 			return err
 		}
-		plan, err = selectOrdersForDelivery(ctx, orders, robotID, capacity)
+		plan, err = selectPlan(ctx, orders, robotID, capacity, optimizer, s.config.Priority, granularity)
 		if err != nil {
 			return err
 		}
 		if len(plan.Orders) > 0 {
+			quantities := make(map[int64]int, len(orders))
+			for _, order := range orders {
+				quantities[order.OrderID] = units(order)
+			}
 			orderIDs := make([]int64, len(plan.Orders))
+			splits := make(map[int64]int)
 			for i, order := range plan.Orders {
 				orderIDs[i] = order.OrderID
+				if units(order) < quantities[order.OrderID] {
+					splits[order.OrderID] = units(order)
+				}
+			}
+			if err := txStore.OrderRepo.SplitOrders(ctx, splits); err != nil {
+				return err
 			}
 
-			if err := txStore.OrderRepo.UpdateStatuses(ctx, orderIDs, "delivering"); err != nil {
+			now := time.Now()
+			assigned, err := txStore.OrderRepo.AssignToRobot(ctx, robotID, orderIDs, now.Add(s.config.LeaseDuration))
+			if err != nil {
+				return err
+			}
+			// 計画の計算中にキャンセルされた注文は計画から除く
+			if len(assigned) < len(orderIDs) {
+				retainOrders(&plan, assigned)
+				orderIDs = assigned
+				if len(orderIDs) == 0 {
+					return nil
+				}
+			}
+			plan.PlanID, err = txStore.DeliveryPlanRepo.Create(ctx, &plan, capacity, now)
+			if err != nil {
 				return err
 			}
-			log.Printf("Updated status to 'delivering' for %d orders", len(orderIDs))
+			log.Printf("Updated status to 'delivering' for %d orders (robot: %s)", len(orderIDs), robotID)
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	clearSelectionFields(plan.Orders)
 	return &plan, nil
 }
 
-func (s *RobotService) UpdateOrderStatus(ctx context.Context, orderID int64, newStatus string) error {
-	return utils.WithTimeout(ctx, func(ctx context.Context) error {
-		return s.store.OrderRepo.UpdateStatuses(ctx, []int64{orderID}, newStatus)
+// ロボットに渡せなかった配送計画の注文を shipping に戻し、他のロボットに割り当てられるようにする
+// すでにロボットが配送結果を報告した注文や、別のロボットに割り当て直された注文は変更しない
+func (s *RobotService) ReleaseDeliveryPlan(ctx context.Context, plan *model.DeliveryPlan) error {
+	orderIDs := make([]int64, len(plan.Orders))
+	for i, order := range plan.Orders {
+		orderIDs[i] = order.OrderID
+	}
+	return s.store.ExecTx(ctx, func(txStore *repository.Store) error {
+		results, err := txStore.OrderRepo.TransitionStatuses(ctx, orderIDs, "shipping", func(current model.Order) error {
+			if current.ShippedStatus != "delivering" || current.RobotID.String != plan.RobotID {
+				return ErrInvalidStatusTransition
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		released := make([]int64, 0, len(orderIDs))
+		for _, orderID := range orderIDs {
+			if results[orderID] == nil {
+				released = append(released, orderID)
+			}
+		}
+		if len(released) > 0 {
+			log.Printf("Released %d undelivered orders of robot %s back to 'shipping'", len(released), plan.RobotID)
+		}
+		return txStore.DeliveryPlanRepo.FinishOrders(ctx, released, "released", time.Now())
 	})
 }
 
-func (s *RobotService) HasShippingOrders(ctx context.Context) (bool, error) {
-	var hasOrders bool
+// ロボットからの報告に基づき注文ステータスを更新する
+// 遷移表で許可されない遷移は ErrInvalidStatusTransition を返す
+// delivering への遷移は配送計画の生成時に、cancelled への遷移はユーザーのキャンセル時にのみ行うため、ここでは受け付けない
+func (s *RobotService) UpdateOrderStatus(ctx context.Context, orderID int64, newStatus string) error {
+	errs, err := s.applyStatusUpdates(ctx, []model.UpdateOrderStatusRequest{{OrderID: orderID, NewStatus: newStatus}})
+	if err != nil {
+		return err
+	}
+	return errs[0]
+}
+
+// 複数の注文ステータスを1トランザクションで更新し、注文ごとの結果を返す
+// 個々の注文の遷移が拒否されても、他の注文の更新は行う
+func (s *RobotService) UpdateOrderStatuses(ctx context.Context, updates []model.UpdateOrderStatusRequest) ([]model.UpdateOrderStatusResult, error) {
+	errs, err := s.applyStatusUpdates(ctx, updates)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]model.UpdateOrderStatusResult, len(updates))
+	for i, u := range updates {
+		results[i] = model.UpdateOrderStatusResult{OrderID: u.OrderID, NewStatus: u.NewStatus, Result: "applied"}
+		switch {
+		case errs[i] == nil:
+		case errors.Is(errs[i], ErrOrderNotFound):
+			results[i].Result = "not_found"
+		default:
+			results[i].Result = "rejected"
+			results[i].Error = errs[i].Error()
+		}
+	}
+	return results, nil
+}
+
+// ステータス更新をまとめて適用し、更新ごとのエラー (nil は適用済み) を返す
+// キャッシュへの反映はすべての更新のコミット後に行われるため、途中で失敗しても一部だけが反映されることはない
+func (s *RobotService) applyStatusUpdates(ctx context.Context, updates []model.UpdateOrderStatusRequest) ([]error, error) {
+	errs := make([]error, len(updates))
+	index := make(map[int64]int, len(updates))
+	newStatuses := make(map[int64]string, len(updates))
+	for i, u := range updates {
+		if _, dup := index[u.OrderID]; dup {
+			errs[i] = ErrDuplicateOrderUpdate
+			continue
+		}
+		index[u.OrderID] = i
+		if !isKnownStatus(u.NewStatus) {
+			errs[i] = ErrUnknownStatus
+			continue
+		}
+		if u.NewStatus == "delivering" || u.NewStatus == "cancelled" {
+			errs[i] = ErrInvalidStatusTransition
+			continue
+		}
+		newStatuses[u.OrderID] = u.NewStatus
+	}
+	if len(newStatuses) == 0 {
+		return errs, nil
+	}
+
 	err := utils.WithTimeout(ctx, func(ctx context.Context) error {
-		count, err := s.store.OrderRepo.CountShippingOrders(ctx)
+		return s.store.ExecTx(ctx, func(txStore *repository.Store) error {
+			now := time.Now()
+			results, err := txStore.OrderRepo.TransitionStatusesTo(ctx, newStatuses, func(current model.Order, newStatus string) error {
+				if !canTransition(current.ShippedStatus, newStatus) {
+					return ErrInvalidStatusTransition
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			// 配送計画の履歴には遷移先ごとにまとめて記録する
+			applied := make(map[string][]int64)
+			statuses := make([]string, 0)
+			for i, u := range updates {
+				newStatus, ok := newStatuses[u.OrderID]
+				if !ok || index[u.OrderID] != i {
+					continue
+				}
+				switch err := results[u.OrderID]; {
+				case err == nil:
+					if _, ok := applied[newStatus]; !ok {
+						statuses = append(statuses, newStatus)
+					}
+					applied[newStatus] = append(applied[newStatus], u.OrderID)
+				case errors.Is(err, sql.ErrNoRows):
+					errs[i] = ErrOrderNotFound
+				default:
+					errs[i] = err
+				}
+			}
+			for _, newStatus := range statuses {
+				if err := txStore.DeliveryPlanRepo.FinishOrders(ctx, applied[newStatus], newStatus, now); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// 配送計画を試算する。注文の割り当ては行わず、状態を一切変更しない
+func (s *RobotService) PreviewDeliveryPlan(ctx context.Context, robotID string, capacity model.Capacity, strategy, granularity string) (*model.DeliveryPlan, error) {
+	if strategy == "" {
+		strategy = s.config.DefaultOptimizer
+	}
+	optimizer, err := lookupOptimizer(strategy)
+	if err != nil {
+		return nil, err
+	}
+	if granularity == "" {
+		granularity = s.config.DefaultGranularity
+	}
+	if err := validateGranularity(granularity); err != nil {
+		return nil, err
+	}
+
+	orders, err := s.store.OrderRepo.GetShippingOrders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := selectPlan(ctx, orders, robotID, capacity, optimizer, s.config.Priority, granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := model.PlanStats{Candidates: len(orders)}
+	for _, order := range orders {
+		if fits(add(model.Capacity{}, order), capacity) {
+			stats.Eligible++
+		}
+		stats.ValueLeftOnTable += order.Value
+	}
+	stats.ValueLeftOnTable -= plan.TotalValue
+	plan.Stats = &stats
+	clearSelectionFields(plan.Orders)
+	return &plan, nil
+}
+
+// ロボットが現在配送中として保持している注文を取得
+func (s *RobotService) GetRobotOrders(ctx context.Context, robotID string) (*model.RobotOrders, error) {
+	orders, err := s.store.OrderRepo.GetRobotOrders(ctx, robotID)
+	if err != nil {
+		return nil, err
+	}
+	return &model.RobotOrders{RobotID: robotID, Orders: orders}, nil
+}
+
+// リース期限切れの注文を定期的に shipping に戻す
+// ctx がキャンセルされるまでブロックする
+func (s *RobotService) RunLeaseReaper(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-cache.Ready():
+	}
+
+	ticker := time.NewTicker(s.config.LeaseReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			var released []int64
+			err := s.store.ExecTx(ctx, func(txStore *repository.Store) error {
+				var err error
+				released, err = txStore.OrderRepo.ReleaseExpiredLeases(ctx, now)
+				if err != nil {
+					return err
+				}
+				return txStore.DeliveryPlanRepo.FinishOrders(ctx, released, "expired", now)
+			})
+			if err != nil {
+				log.Printf("Failed to release expired leases: %v", err)
+				continue
+			}
+			if len(released) > 0 {
+				log.Printf("Released %d orders with expired leases back to 'shipping'", len(released))
+			}
+		}
+	}
+}
+
+// shipping の注文が存在するまで待機する
+// PlanMaxWait を過ぎても注文がなければ false を返す
+func (s *RobotService) WaitForShippingOrders(ctx context.Context) (bool, error) {
+	timer := time.NewTimer(s.config.PlanMaxWait)
+	defer timer.Stop()
+	for {
+		// 確認と待機の間に追加された注文を取りこぼさないよう、先に待機用チャネルを取得する
+		added := s.ShippingOrdersAdded()
+		hasOrders, err := s.HasShippingOrders(ctx)
 		if err != nil {
-			return err
+			return false, err
 		}
-		hasOrders = count > 0
-		return nil
-	})
+		if hasOrders {
+			return true, nil
+		}
+
+		select {
+		case <-added:
+		case <-timer.C:
+			return false, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// 次に shipping の注文が追加されたときに close されるチャネルを返す
+func (s *RobotService) ShippingOrdersAdded() <-chan struct{} {
+	return cache.ShippingOrdersNotifier.Wait()
+}
+
+func (s *RobotService) HasShippingOrders(ctx context.Context) (bool, error) {
+	count, err := s.CountShippingOrders(ctx)
 	if err != nil {
 		return false, err
 	}
-	return hasOrders, nil
+	return count > 0, nil
+}
+
+func (s *RobotService) CountShippingOrders(ctx context.Context) (int, error) {
+	var count int
+	err := utils.WithTimeout(ctx, func(ctx context.Context) error {
+		var err error
+		count, err = s.store.OrderRepo.CountShippingOrders(ctx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// granularity に応じた単位で配送する注文を選ぶ
+// unit の場合、計画に含まれる明細の Quantity は積む個数で、明細の数量より少ないことがある
+func selectPlan(ctx context.Context, orders []model.Order, robotID string, capacity model.Capacity, optimizer deliveryOptimizer, priority PriorityConfig, granularity string) (model.DeliveryPlan, error) {
+	if granularity != GranularityUnit {
+		return selectOrdersForDelivery(ctx, orders, robotID, capacity, optimizer, priority)
+	}
+	candidates, chunks := splitIntoUnitChunks(orders)
+	plan, err := selectOrdersForDelivery(ctx, candidates, robotID, capacity, optimizer, priority)
+	if err != nil {
+		return plan, err
+	}
+	mergeUnitChunks(&plan, chunks)
+	return plan, nil
 }
 
-func selectOrdersForDelivery(ctx context.Context, orders []model.Order, robotID string, robotCapacity int) (model.DeliveryPlan, error) {
+// 容量内で実効優先度の合計が最大になる注文を選ぶ
+// 期限超過の注文は優先度に関係なく古い順に先に積み、残りの容量を optimizer で埋める
+func selectOrdersForDelivery(ctx context.Context, orders []model.Order, robotID string, robotCapacity model.Capacity, optimizer deliveryOptimizer, priority PriorityConfig) (model.DeliveryPlan, error) {
 	_ = ctx
-	prunedOrders := make([]model.Order, 0, len(orders))
-	for _, order := range orders {
-		if order.Weight <= robotCapacity {
-			prunedOrders = append(prunedOrders, order)
+	start := time.Now()
+	// 重さ以外の制約があり、指定のアルゴリズムが対応していなければ分枝限定法で解く
+	// 探索ノード数の上限に達した場合は、それまでの最良解 (少なくとも貪欲法の解) になる
+	if isMultiDimensional(robotCapacity) && !optimizer.MultiDimensional() {
+		optimizer = branchAndBoundOptimizer{}
+	}
+
+	prioritized := priority.apply(orders, start)
+	forced, used := takeOverdue(prioritized, robotCapacity)
+
+	// optimizer は Value を最大化するため、Value を実効優先度に置き換えて渡す
+	var total model.Capacity
+	prunedOrders := make([]model.Order, 0, len(prioritized))
+	original := make(map[int64]model.Order, len(prioritized))
+	for _, order := range prioritized {
+		if order.Overdue || !fits(add(used, order), robotCapacity) {
+			continue
 		}
+		original[order.OrderID] = order
+		order.Value = order.Priority
+		prunedOrders = append(prunedOrders, order)
+		total = add(total, order)
 	}
 
-	wTotal := 0
-	for _, order := range prunedOrders {
-		wTotal += order.Weight
+	rest := subtract(robotCapacity, used)
+	selected := prunedOrders
+	strategy := StrategyAll
+	switch {
+	case len(prunedOrders) == 0:
+		strategy = StrategyNone
+	case !fits(total, rest):
+		selected = optimizer.Select(prunedOrders, rest)
+		strategy = optimizer.Name()
 	}
-	if wTotal <= robotCapacity {
-		vTotal := 0
-		for _, order := range prunedOrders {
-			vTotal += order.Value
-		}
-		return model.DeliveryPlan{
-			RobotID:     robotID,
-			TotalWeight: wTotal,
-			TotalValue:  vTotal,
-			Orders:      orders,
-		}, nil
+
+	bestSet := forced
+	for _, order := range selected {
+		bestSet = append(bestSet, original[order.OrderID])
 	}
 
-	bestSet := findBestSetRecursive(prunedOrders, robotCapacity)
 	bestValue := 0
 	totalWeight := 0
+	totalVolume := 0
 	for _, order := range bestSet {
 		bestValue += order.Value
 		totalWeight += order.Weight
+		totalVolume += order.Volume
 	}
 
 	return model.DeliveryPlan{
-		RobotID:     robotID,
-		TotalWeight: totalWeight,
-		TotalValue:  bestValue,
-		Orders:      bestSet,
+		RobotID:         robotID,
+		TotalWeight:     totalWeight,
+		TotalVolume:     totalVolume,
+		TotalValue:      bestValue,
+		Orders:          bestSet,
+		Strategy:        strategy,
+		OptimizerTimeUs: time.Since(start).Microseconds(),
 	}, nil
 }
 
+// 商品IDと作成日時は注文の選択 (優先度の計算) にのみ使い、配送計画の注文としては返さない
+func clearSelectionFields(orders []model.Order) {
+	for i := range orders {
+		orders[i].ProductID = 0
+		orders[i].CreatedAt = time.Time{}
+	}
+}
+
+// 配送計画を orderIDs に含まれる注文のみに絞り、合計値を計算し直す
+func retainOrders(plan *model.DeliveryPlan, orderIDs []int64) {
+	keep := make(map[int64]struct{}, len(orderIDs))
+	for _, id := range orderIDs {
+		keep[id] = struct{}{}
+	}
+	orders := make([]model.Order, 0, len(orderIDs))
+	plan.TotalWeight, plan.TotalVolume, plan.TotalValue = 0, 0, 0
+	for _, order := range plan.Orders {
+		if _, ok := keep[order.OrderID]; !ok {
+			continue
+		}
+		orders = append(orders, order)
+		plan.TotalWeight += order.Weight
+		plan.TotalVolume += order.Volume
+		plan.TotalValue += order.Value
+	}
+	plan.Orders = orders
+}
+
 // 再帰的に最適な品物セットを見つける関数
 func findBestSetRecursive(orders []model.Order, capacity int) []model.Order {
 	n := len(orders)
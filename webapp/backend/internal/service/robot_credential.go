@@ -0,0 +1,241 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/repository"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+var ErrRobotCredentialNotFound = errors.New("robot credential not found")
+
+// ローテーション時に既存キーを使える猶予時間の上限
+const maxRobotKeyOverlap = 7 * 24 * time.Hour
+
+// ロボットごとのAPIキーを管理する
+// 認証はリクエストごとに行われるため、有効なキーはメモリ上にハッシュをキーとして保持する
+// 保持する内容は発行・失効時と RunReloader で定期的に読み直す
+type RobotCredentialService struct {
+	store *repository.Store
+	// 署名鍵の導出に使う秘密鍵。DBには保存しない
+	signingSecret []byte
+
+	mu     sync.RWMutex
+	loaded bool
+	byHash map[string]model.RobotCredential
+	// キーのハッシュごとの署名鍵
+	signingKeys map[string]string
+}
+
+func NewRobotCredentialService(store *repository.Store, signingSecret []byte) *RobotCredentialService {
+	return &RobotCredentialService{
+		store:         store,
+		signingSecret: signingSecret,
+		byHash:        make(map[string]model.RobotCredential),
+		signingKeys:   make(map[string]string),
+	}
+}
+
+// 保存するキーのハッシュ。他の用途のハッシュと衝突しないよう接頭辞を付ける
+func hashRobotKey(apiKey string) string {
+	sum := sha256.Sum256([]byte("robot-api-key-hash:v1\n" + apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// キーのハッシュとサーバーの秘密鍵から HKDF で署名鍵を導出する
+// DBが漏洩しても秘密鍵がなければ署名鍵は分からない
+func (s *RobotCredentialService) signingKey(keyHash string) (string, error) {
+	key := make([]byte, 32)
+	r := hkdf.New(sha256.New, s.signingSecret, nil, []byte("robot-signing-key:v1\n"+keyHash))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func generateRobotKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "rk_" + hex.EncodeToString(b), nil
+}
+
+// 有効なキーをDBから読み直す
+func (s *RobotCredentialService) reload(ctx context.Context) error {
+	creds, err := s.store.RobotCredRepo.ListValid(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	byHash := make(map[string]model.RobotCredential, len(creds))
+	signingKeys := make(map[string]string, len(creds))
+	for _, c := range creds {
+		key, err := s.signingKey(c.KeyHash)
+		if err != nil {
+			return err
+		}
+		byHash[c.KeyHash] = c
+		signingKeys[c.KeyHash] = key
+	}
+	s.mu.Lock()
+	s.byHash = byHash
+	s.signingKeys = signingKeys
+	s.loaded = true
+	s.mu.Unlock()
+	return nil
+}
+
+// APIキーを検証し、キーに紐づくロボットIDを返す
+// 失効済み・期限切れのキーは無効とする
+func (s *RobotCredentialService) Authenticate(ctx context.Context, apiKey string) (string, bool) {
+	if !s.ensureLoaded(ctx) {
+		return "", false
+	}
+
+	s.mu.RLock()
+	cred, ok := s.byHash[hashRobotKey(apiKey)]
+	s.mu.RUnlock()
+	if !ok || !isCredentialValid(cred, time.Now()) {
+		return "", false
+	}
+	return cred.RobotID, true
+}
+
+// ロボットの有効なキーの署名鍵を取得する
+// ローテーション中は新旧両方のキーが含まれる
+func (s *RobotCredentialService) SigningKeys(ctx context.Context, robotID string) []string {
+	if !s.ensureLoaded(ctx) {
+		return nil
+	}
+
+	now := time.Now()
+	var keys []string
+	s.mu.RLock()
+	for hash, cred := range s.byHash {
+		if cred.RobotID == robotID && isCredentialValid(cred, now) {
+			keys = append(keys, s.signingKeys[hash])
+		}
+	}
+	s.mu.RUnlock()
+	return keys
+}
+
+func (s *RobotCredentialService) ensureLoaded(ctx context.Context) bool {
+	s.mu.RLock()
+	loaded := s.loaded
+	s.mu.RUnlock()
+	if loaded {
+		return true
+	}
+	if err := s.reload(ctx); err != nil {
+		log.Printf("Failed to load robot credentials: %v", err)
+		return false
+	}
+	return true
+}
+
+// 有効なキーを interval ごとにDBから読み直す
+// 他のインスタンスやDBの直接の変更で発行・失効したキーも、interval 以内に反映される
+func (s *RobotCredentialService) RunReloader(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.reload(ctx); err != nil {
+				log.Printf("Failed to reload robot credentials: %v", err)
+			}
+		}
+	}
+}
+
+func isCredentialValid(cred model.RobotCredential, now time.Time) bool {
+	if cred.RevokedAt != nil {
+		return false
+	}
+	return cred.ExpiresAt == nil || now.Before(*cred.ExpiresAt)
+}
+
+// ロボットのキーを失効済みのものも含めて取得
+func (s *RobotCredentialService) List(ctx context.Context, robotID string) ([]model.RobotCredential, error) {
+	return s.store.RobotCredRepo.ListByRobot(ctx, robotID)
+}
+
+// ロボットに新しいキーを発行する。既存のキーはそのまま有効
+func (s *RobotCredentialService) Issue(ctx context.Context, robotID string) (*model.IssuedRobotKey, error) {
+	return s.issue(ctx, robotID, nil)
+}
+
+// ロボットに新しいキーを発行し、既存の有効なキーを overlap 経過後に失効させる
+// overlap が 0 の場合は既存のキーを即時に失効させる
+func (s *RobotCredentialService) Rotate(ctx context.Context, robotID string, overlap time.Duration) (*model.IssuedRobotKey, error) {
+	if overlap < 0 {
+		overlap = 0
+	}
+	if overlap > maxRobotKeyOverlap {
+		overlap = maxRobotKeyOverlap
+	}
+	return s.issue(ctx, robotID, &overlap)
+}
+
+func (s *RobotCredentialService) issue(ctx context.Context, robotID string, overlap *time.Duration) (*model.IssuedRobotKey, error) {
+	apiKey, err := generateRobotKey()
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Truncate(time.Second)
+	cred := model.RobotCredential{
+		KeyID:     keyID.String(),
+		RobotID:   robotID,
+		KeyHash:   hashRobotKey(apiKey),
+		CreatedAt: now,
+	}
+	signingKey, err := s.signingKey(cred.KeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.ExecTx(ctx, func(txStore *repository.Store) error {
+		if overlap != nil {
+			if err := txStore.RobotCredRepo.ExpireValid(ctx, robotID, now.Add(*overlap)); err != nil {
+				return err
+			}
+		}
+		return txStore.RobotCredRepo.Create(ctx, &cred)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.reload(ctx); err != nil {
+		return nil, err
+	}
+	return &model.IssuedRobotKey{RobotCredential: cred, APIKey: apiKey, SigningKey: signingKey}, nil
+}
+
+// キーを即時に失効させる
+func (s *RobotCredentialService) Revoke(ctx context.Context, robotID, keyID string) error {
+	ok, err := s.store.RobotCredRepo.Revoke(ctx, robotID, keyID, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrRobotCredentialNotFound
+	}
+	return s.reload(ctx)
+}
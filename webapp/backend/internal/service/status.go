@@ -0,0 +1,36 @@
+package service
+
+import "errors"
+
+var (
+	ErrOrderNotFound           = errors.New("order not found")
+	ErrUnknownStatus           = errors.New("unknown order status")
+	ErrInvalidStatusTransition = errors.New("invalid order status transition")
+	ErrDuplicateOrderUpdate    = errors.New("duplicate order_id in batch")
+)
+
+// 注文ステータスの遷移表
+// completed、returned、cancelled は終端状態で、以降の遷移は許可しない
+// cancelled への遷移はユーザーによるキャンセルでのみ行う
+var statusTransitions = map[string][]string{
+	"shipping":   {"delivering", "cancelled"},
+	"delivering": {"completed", "failed", "shipping"},
+	"failed":     {"shipping", "returned"},
+	"completed":  {},
+	"returned":   {},
+	"cancelled":  {},
+}
+
+func isKnownStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package service
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{"shipping", "delivering", true},
+		{"shipping", "cancelled", true},
+		{"delivering", "completed", true},
+		{"delivering", "failed", true},
+		{"delivering", "shipping", true},
+		{"failed", "shipping", true},
+		{"failed", "returned", true},
+
+		{"shipping", "shipping", false},
+		{"shipping", "completed", false},
+		{"shipping", "failed", false},
+		{"shipping", "returned", false},
+		{"delivering", "cancelled", false},
+		{"delivering", "returned", false},
+		{"failed", "delivering", false},
+		{"failed", "completed", false},
+		{"failed", "cancelled", false},
+		// 終端状態からは遷移できない
+		{"completed", "shipping", false},
+		{"completed", "returned", false},
+		{"returned", "shipping", false},
+		{"cancelled", "shipping", false},
+		// 遷移表にないステータス
+		{"unknown", "shipping", false},
+		{"shipping", "unknown", false},
+		{"", "shipping", false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestIsKnownStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{"shipping", true},
+		{"delivering", true},
+		{"failed", true},
+		{"completed", true},
+		{"returned", true},
+		{"cancelled", true},
+		{"", false},
+		{"SHIPPING", false},
+		{"unknown", false},
+	}
+	for _, tt := range tests {
+		if got := isKnownStatus(tt.status); got != tt.want {
+			t.Errorf("isKnownStatus(%q) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+// 遷移先はすべて遷移表に定義されたステータスであること
+func TestStatusTransitionsTargetsAreKnown(t *testing.T) {
+	for from, targets := range statusTransitions {
+		for _, to := range targets {
+			if !isKnownStatus(to) {
+				t.Errorf("transition %q -> %q targets an unknown status", from, to)
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"backend/internal/model"
+	"backend/internal/repository"
+	"backend/pkg/webhooksig"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWebhookNotFound         = errors.New("webhook not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrInvalidWebhookURL       = errors.New("webhook URL must be an absolute http or https URL")
+	ErrUnknownDeliveryStatus   = errors.New("unknown webhook delivery status")
+)
+
+type WebhookConfig struct {
+	// この回数だけ送信に失敗したら再送をやめて dead にする
+	MaxAttempts int
+	// 再送間隔。失敗するたびに2倍にし、RetryMaxDelay を上限とする
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	// 送信待ちを確認する間隔と、一度に送信する件数
+	PollInterval time.Duration
+	BatchSize    int
+	// 1回の送信のタイムアウト
+	Timeout time.Duration
+}
+
+// 注文ステータスの変更を Webhook で通知する
+// 通知は注文ステータスの変更と同じトランザクションで outbox に登録され、RunDispatcher が送信する
+type WebhookService struct {
+	store  *repository.Store
+	config WebhookConfig
+	client *http.Client
+}
+
+func NewWebhookService(store *repository.Store, config WebhookConfig) *WebhookService {
+	return &WebhookService{
+		store:  store,
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+}
+
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Webhook の送信先を登録し、署名の鍵を発行する
+func (s *WebhookService) Register(ctx context.Context, rawURL string) (*model.RegisteredWebhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidWebhookURL
+	}
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+	webhook := model.Webhook{
+		URL:       u.String(),
+		Secret:    secret,
+		CreatedAt: time.Now().Truncate(time.Second),
+	}
+	if err := s.store.WebhookRepo.Create(ctx, &webhook); err != nil {
+		return nil, err
+	}
+	return &model.RegisteredWebhook{Webhook: webhook, Secret: secret}, nil
+}
+
+// Webhook の送信先を無効化したものも含めて取得
+func (s *WebhookService) List(ctx context.Context) ([]model.Webhook, error) {
+	return s.store.WebhookRepo.List(ctx)
+}
+
+// Webhook の送信先を無効化する。送信待ちの通知は送信せずに dead になる
+func (s *WebhookService) Disable(ctx context.Context, webhookID int64) error {
+	ok, err := s.store.WebhookRepo.Deactivate(ctx, webhookID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// 指定した状態の送信を新しい順に取得
+func (s *WebhookService) ListDeliveries(ctx context.Context, status string, limit int) ([]model.WebhookDelivery, error) {
+	switch status {
+	case repository.WebhookDeliveryPending, repository.WebhookDeliveryDelivered, repository.WebhookDeliveryDead:
+	default:
+		return nil, ErrUnknownDeliveryStatus
+	}
+	return s.store.WebhookRepo.ListDeliveries(ctx, status, limit)
+}
+
+// 再送上限に達した送信を、もう一度送信待ちに戻す
+// dead でない送信は ErrWebhookDeliveryNotFound とする
+func (s *WebhookService) Replay(ctx context.Context, deliveryID int64) error {
+	ok, err := s.store.WebhookRepo.Replay(ctx, deliveryID, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrWebhookDeliveryNotFound
+	}
+	return nil
+}
+
+// 送信待ちの通知を定期的に送信する
+// 送信待ちは DB 上で排他的に取得するため、複数のプロセスで動かしてもよい
+func (s *WebhookService) RunDispatcher(ctx context.Context) {
+	ticker := time.NewTicker(s.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// 1回で送りきれなかった場合は続けて送信する
+			for {
+				n, err := s.dispatch(ctx)
+				if err != nil {
+					log.Printf("Failed to dispatch webhooks: %v", err)
+					break
+				}
+				if n < s.config.BatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// 送信時刻を過ぎた通知をまとめて送信し、取得した件数を返す
+func (s *WebhookService) dispatch(ctx context.Context) (int, error) {
+	var deliveries []model.WebhookDelivery
+	err := s.store.ExecTx(ctx, func(txStore *repository.Store) error {
+		var err error
+		// 送信中に他の送信処理が同じ通知を取得しないよう、タイムアウトより長く確保する
+		deliveries, err = txStore.WebhookRepo.ClaimDue(ctx, time.Now(), s.config.BatchSize, 2*s.config.Timeout)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		wg.Add(1)
+		go func(d model.WebhookDelivery) {
+			defer wg.Done()
+			if err := s.deliver(ctx, d); err != nil {
+				log.Printf("Failed to record webhook delivery %d: %v", d.DeliveryID, err)
+			}
+		}(d)
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+// 通知を1件送信し、結果を記録する
+func (s *WebhookService) deliver(ctx context.Context, d model.WebhookDelivery) error {
+	if !d.Active {
+		return s.store.WebhookRepo.MarkFailed(ctx, d.DeliveryID, d.Attempts, nil, "webhook is disabled", time.Now(), true)
+	}
+
+	attempts := d.Attempts + 1
+	statusCode, sendErr := s.send(ctx, d)
+	now := time.Now()
+	if sendErr == nil {
+		return s.store.WebhookRepo.MarkDelivered(ctx, d.DeliveryID, attempts, statusCode, now)
+	}
+
+	var code *int
+	if statusCode != 0 {
+		code = &statusCode
+	}
+	dead := attempts >= s.config.MaxAttempts
+	if dead {
+		log.Printf("Webhook delivery %d to %s gave up after %d attempts: %v", d.DeliveryID, d.URL, attempts, sendErr)
+	}
+	return s.store.WebhookRepo.MarkFailed(ctx, d.DeliveryID, attempts, code, sendErr.Error(), now.Add(s.retryDelay(attempts)), dead)
+}
+
+// 署名を付けて送信し、レスポンスのステータスコードを返す。2xx 以外はエラーとする
+func (s *WebhookService) send(ctx context.Context, d model.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhooksig.HeaderEventID, d.EventID)
+	req.Header.Set(webhooksig.HeaderTimestamp, timestamp)
+	req.Header.Set(webhooksig.HeaderSignature, webhooksig.Signature(d.Secret, timestamp, d.Payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// attempts 回失敗した後の再送までの待ち時間
+func (s *WebhookService) retryDelay(attempts int) time.Duration {
+	delay := s.config.RetryBaseDelay
+	for i := 1; i < attempts && delay < s.config.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.config.RetryMaxDelay {
+		delay = s.config.RetryMaxDelay
+	}
+	return delay
+}
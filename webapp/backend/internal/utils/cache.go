@@ -3,6 +3,7 @@ package utils
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/goccy/go-json"
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -58,6 +59,8 @@ func NewInMemoryLRUCache[K comparable, V any](size int) (Cache[K, V], error) {
 
 type redisCache[V any] struct {
 	rdb redis.Client
+	// 0 の場合は期限なし
+	expiration time.Duration
 }
 
 func (c *redisCache[V]) Get(ctx context.Context, key string) (Maybe[V], error) {
@@ -84,7 +87,7 @@ func (c *redisCache[V]) Set(ctx context.Context, key string, value V) error {
 		return err
 	}
 
-	err = c.rdb.Set(ctx, key, b, 0).Err()
+	err = c.rdb.Set(ctx, key, b, c.expiration).Err()
 	if err != nil {
 		return err
 	}
@@ -107,3 +110,8 @@ func (c *redisCache[V]) Clear(ctx context.Context) error {
 func NewRedisCache[V any](rdb redis.Client) Cache[string, V] {
 	return &redisCache[V]{rdb: rdb}
 }
+
+// expiration を過ぎたキーを Redis が自動的に削除する Cache を作成する
+func NewRedisCacheWithExpiration[V any](rdb redis.Client, expiration time.Duration) Cache[string, V] {
+	return &redisCache[V]{rdb: rdb, expiration: expiration}
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+type Event[T any] struct {
+	ID    int64
+	Value T
+}
+
+// キーごとに直近のイベントを保持し、追記を待機中の goroutine に通知する
+// イベントIDは全キーで共通の連番で、再接続したクライアントは受け取った最後のIDから続きを取得できる
+// IDは起動時刻 (マイクロ秒) から始めるため、再起動前に発行したIDは常に startID より小さくなる
+type EventLog[T any] struct {
+	mu       sync.Mutex
+	capacity int
+	startID  int64
+	lastID   int64
+	events   map[int][]Event[T]
+	// キーごとに、保持しきれず捨てたイベントの最大ID
+	dropped map[int]int64
+	waiters map[int]chan struct{}
+}
+
+// capacity はキーごとに保持するイベント数
+func NewEventLog[T any](capacity int) *EventLog[T] {
+	start := time.Now().UnixMicro()
+	return &EventLog[T]{
+		capacity: capacity,
+		startID:  start,
+		lastID:   start,
+		events:   make(map[int][]Event[T]),
+		dropped:  make(map[int]int64),
+		waiters:  make(map[int]chan struct{}),
+	}
+}
+
+// イベントを追記し、そのキーの待機中の goroutine に通知する
+func (l *EventLog[T]) Append(key int, value T) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastID++
+	events := append(l.events[key], Event[T]{ID: l.lastID, Value: value})
+	if len(events) > l.capacity {
+		drop := len(events) - l.capacity
+		l.dropped[key] = events[drop-1].ID
+		events = append(events[:0:0], events[drop:]...)
+	}
+	l.events[key] = events
+
+	if ch, ok := l.waiters[key]; ok {
+		close(ch)
+		delete(l.waiters, key)
+	}
+	return l.lastID
+}
+
+// 最後に発行したイベントID。これを Since に渡すと、以降に追記されたイベントだけを取得できる
+func (l *EventLog[T]) LastID() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastID
+}
+
+// afterID より後のキーのイベントと、次にそのキーへ追記されたときに close されるチャネルを返す
+// afterID 以降のイベントを取りこぼしている可能性がある場合 (捨てたイベントがある、
+// 再起動前や未発行のIDが指定された) は complete が false になる
+func (l *EventLog[T]) Since(key int, afterID int64) (events []Event[T], complete bool, wait <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	complete = afterID >= l.startID && afterID <= l.lastID && afterID >= l.dropped[key]
+	for _, e := range l.events[key] {
+		if e.ID > afterID {
+			events = append(events, e)
+		}
+	}
+
+	ch, ok := l.waiters[key]
+	if !ok {
+		ch = make(chan struct{})
+		l.waiters[key] = ch
+	}
+	return events, complete, ch
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// キーごとの排他ロック。取得できなければ待たずに false を返す
+type Locker interface {
+	// 取得できた場合は解放する関数を返す
+	TryLock(ctx context.Context, key string) (unlock func(), ok bool, err error)
+}
+
+// プロセス内でのみ有効なロック
+type inMemoryLocker struct {
+	held sync.Map
+}
+
+func NewInMemoryLocker() Locker {
+	return &inMemoryLocker{}
+}
+
+func (l *inMemoryLocker) TryLock(ctx context.Context, key string) (func(), bool, error) {
+	if _, busy := l.held.LoadOrStore(key, struct{}{}); busy {
+		return nil, false, nil
+	}
+	return func() { l.held.Delete(key) }, true, nil
+}
+
+// Redis の SET NX による、複数のプロセスで共有するロック
+// 解放されないまま expiration を過ぎたロックは自動的に外れる
+type redisLocker struct {
+	rdb        redis.Client
+	expiration time.Duration
+}
+
+func NewRedisLocker(rdb redis.Client, expiration time.Duration) Locker {
+	return &redisLocker{rdb: rdb, expiration: expiration}
+}
+
+// 自分が取得したロックのみを削除する
+var redisUnlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+func (l *redisLocker) TryLock(ctx context.Context, key string) (func(), bool, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(b)
+	ok, err := l.rdb.SetNX(ctx, key, token, l.expiration).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return func() {
+		// リクエストがキャンセルされていても解放できるよう、元の context のキャンセルは引き継がない
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		redisUnlockScript.Run(ctx, &l.rdb, []string{key}, token)
+	}, true, nil
+}
@@ -0,0 +1,29 @@
+package utils
+
+import "sync"
+
+// 待機中の全 goroutine に変化を一斉通知する
+// Wait で取得したチャネルは次の Notify で close される
+type Notifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{ch: make(chan struct{})}
+}
+
+// 次の通知で close されるチャネルを返す
+// 通知の取りこぼしを防ぐため、状態を確認する前に呼び出すこと
+func (n *Notifier) Wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+func (n *Notifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
@@ -0,0 +1,48 @@
+import { test, expect } from "@playwright/test";
+
+// 注文の同時作成で、ユーザーに返した注文IDが実際に作成された行と一致すること
+test.describe("POST /api/v1/product/post (concurrent writers)", () => {
+  test("同時に注文しても返却された order_ids が作成した明細と一致すること", async ({
+    request,
+  }) => {
+    const loginResp = await request.post("/api/login", {
+      data: { user_name: "user001", password: "password" },
+    });
+    expect(loginResp.ok()).toBeTruthy();
+
+    // リクエストごとに商品と数量の組み合わせを変え、取り違えがあれば検出できるようにする
+    const writers = 20;
+    const payloads = Array.from({ length: writers }, (_, i) => ({
+      items: [
+        { product_id: 2 * i + 1, quantity: (i % 3) + 1 },
+        { product_id: 2 * i + 2, quantity: (i % 4) + 2 },
+      ],
+    }));
+
+    const responses = await Promise.all(
+      payloads.map((data) => request.post("/api/v1/product/post", { data }))
+    );
+
+    const seen = new Set<number>();
+    for (let i = 0; i < writers; i++) {
+      expect(responses[i].status()).toBe(201);
+      const body = await responses[i].json();
+      // group_id がなければ明細との比較が undefined 同士で通ってしまうため、先に確認する
+      expect(typeof body.group_id).toBe("number");
+      const orderIds: number[] = body.order_ids.map(Number);
+      expect(orderIds).toHaveLength(payloads[i].items.length);
+
+      for (let j = 0; j < orderIds.length; j++) {
+        expect(seen.has(orderIds[j]), "注文IDが重複していないこと").toBeFalsy();
+        seen.add(orderIds[j]);
+
+        const detailResp = await request.get(`/api/v1/orders/${orderIds[j]}`);
+        expect(detailResp.status()).toBe(200);
+        const detail = await detailResp.json();
+        expect(detail.group_id).toBe(body.group_id);
+        expect(detail.product.product_id).toBe(payloads[i].items[j].product_id);
+        expect(detail.quantity).toBe(payloads[i].items[j].quantity);
+      }
+    }
+  });
+});
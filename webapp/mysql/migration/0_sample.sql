@@ -11,6 +11,109 @@ CREATE INDEX idx_image_idd ON products (image DESC, product_id);
 CREATE INDEX idx_weight_id ON products (weight, product_id);
 CREATE INDEX idx_weight_idd ON products (weight DESC, product_id);
 
+ALTER TABLE orders ADD COLUMN robot_id VARCHAR(64) NULL;
+ALTER TABLE orders ADD COLUMN lease_expires_at DATETIME NULL;
+
+-- 商品の容積。API からは設定しないため、容積の制限 (max_volume) を使う場合はここで設定する
+ALTER TABLE products ADD COLUMN volume INT UNSIGNED NOT NULL DEFAULT 0;
+
+CREATE TABLE delivery_plans (
+    plan_id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    robot_id VARCHAR(64) NOT NULL,
+    capacity_weight INT NOT NULL,
+    capacity_volume INT NOT NULL,
+    capacity_items INT NOT NULL,
+    total_weight INT NOT NULL,
+    total_volume INT NOT NULL,
+    total_value INT NOT NULL,
+    strategy VARCHAR(32) NOT NULL,
+    created_at DATETIME NOT NULL,
+    completed_at DATETIME NULL,
+    INDEX idx_robot_id_plan_id (robot_id, plan_id)
+);
+
+CREATE TABLE delivery_plan_orders (
+    plan_id BIGINT UNSIGNED NOT NULL,
+    order_id INT UNSIGNED NOT NULL,
+    final_status VARCHAR(50) NULL,
+    completed_at DATETIME NULL,
+    PRIMARY KEY (plan_id, order_id),
+    INDEX idx_order_id_completed_at (order_id, completed_at),
+    FOREIGN KEY (plan_id) REFERENCES delivery_plans(plan_id) ON DELETE CASCADE
+);
+
+CREATE TABLE robot_credentials (
+    key_id VARCHAR(36) PRIMARY KEY,
+    robot_id VARCHAR(64) NOT NULL,
+    key_hash CHAR(64) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NULL,
+    revoked_at DATETIME NULL,
+    UNIQUE KEY uniq_key_hash (key_hash),
+    INDEX idx_robot_id (robot_id)
+);
+
+CREATE TABLE order_status_history (
+    history_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id INT UNSIGNED NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    robot_id VARCHAR(64) NULL,
+    changed_at DATETIME NOT NULL,
+    INDEX idx_order_id (order_id, history_id)
+);
+
+-- 1回の購入を親注文 (order_groups) とし、orders は商品ごとの明細 (数量つき) とする
+CREATE TABLE order_groups (
+    group_id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    user_id INT UNSIGNED NOT NULL,
+    created_at DATETIME NOT NULL,
+    INDEX idx_user_id_created_at (user_id, created_at)
+);
+ALTER TABLE orders ADD COLUMN quantity INT UNSIGNED NOT NULL DEFAULT 1;
+ALTER TABLE orders ADD COLUMN group_id INT UNSIGNED NOT NULL DEFAULT 0;
+-- 既存の注文は数量1の明細とし、同じユーザーが同時刻に作成したものを1つの親注文にまとめる
+INSERT INTO order_groups (user_id, created_at)
+    SELECT user_id, created_at FROM orders GROUP BY user_id, created_at ORDER BY MIN(order_id);
+UPDATE orders o
+    JOIN order_groups g ON g.user_id = o.user_id AND g.created_at = o.created_at
+    SET o.group_id = g.group_id;
+CREATE INDEX idx_group_id ON orders (group_id);
+
+-- 在庫数の初期値 (1000000) は、在庫管理の導入前から販売している商品の在庫として扱う値。
+-- 導入前は在庫の概念がなく注文数に上限がなかったため、既存の商品が導入を機に売り切れにならないよう、
+-- 実運用で到達しない十分大きな数を列の既定値にして既存の行に設定する。
+-- 商品ごとの実際の在庫数は、在庫を管理し始めた商品から個別に更新する
+ALTER TABLE products ADD COLUMN stock INT UNSIGNED NOT NULL DEFAULT 1000000
+    COMMENT 'default: unlimited stock for products sold before stock management';
+CREATE INDEX idx_stock ON products (stock);
+CREATE INDEX idx_robot_id_status ON orders (robot_id, shipped_status);
+
+-- 注文ステータスの変更を通知する Webhook の送信先
+CREATE TABLE webhooks (
+    webhook_id INT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(128) NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at DATETIME NOT NULL
+);
+-- Webhook の送信待ちと送信結果 (outbox)。ステータスの変更と同じトランザクションで登録する
+-- status は pending (送信待ち・再送待ち) / delivered (送信済み) / dead (再送上限に達した)
+CREATE TABLE webhook_outbox (
+    delivery_id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    webhook_id INT UNSIGNED NOT NULL,
+    event_id VARCHAR(36) NOT NULL,
+    payload JSON NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INT UNSIGNED NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME(3) NOT NULL,
+    last_status_code INT NULL,
+    last_error TEXT NULL,
+    created_at DATETIME NOT NULL,
+    delivered_at DATETIME NULL,
+    INDEX idx_status_next_attempt_at (status, next_attempt_at),
+    INDEX idx_webhook_id (webhook_id)
+);
+
 CREATE TABLE cache (
     target VARCHAR(255) PRIMARY KEY
 );